@@ -0,0 +1,640 @@
+// *************************************************************************
+//
+// REFRACTION POINT CONFIDENTIAL
+// __________________
+//
+//  Copyright 2018 Refraction Point Inc.
+//  All Rights Reserved.
+//
+// NOTICE:  All information contained herein is, and remains
+// the property of Refraction Point Inc. and its suppliers,
+// if any.  The intellectual and technical concepts contained
+// herein are proprietary to Refraction Point Inc
+// and its suppliers and may be covered by U.S. and Foreign Patents,
+// patents in process, and are protected by trade secret or copyright law.
+// Dissemination of this information or reproduction of this material
+// is strictly forbidden unless prior written permission is obtained
+// from Refraction Point Inc.
+//
+
+package arl
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// UnpackMode selects which of the fetched resources Fetch unpacks.
+type UnpackMode int
+
+const (
+	// UnpackSingle unpacks the resource when the ARL points to a single
+	// one, like an HTTP URL or a single blob, but not the resources of
+	// multi-file sources like a repo.
+	UnpackSingle UnpackMode = iota
+	// UnpackNever never unpacks, archives are returned as fetched.
+	UnpackNever
+	// UnpackAlways unpacks every resource which is an archive. For
+	// multi-file sources, the unpacked files are named after the
+	// archive, like "dir/archive.zip/file.yaml".
+	UnpackAlways
+)
+
+// UnpackOptions controls how archives are unpacked by Fetch.
+type UnpackOptions struct {
+	// Mode selects the resources to unpack.
+	Mode UnpackMode
+	// MaxEntries is the maximum number of files unpacked from an
+	// archive, 0 for no limit.
+	MaxEntries int
+	// MaxSize is the maximum number of bytes unpacked from an archive
+	// once decompressed. The maxSize of the ARL applies instead when it
+	// is lower, with both at 0 there is no limit.
+	MaxSize uint64
+	// MaxRatio is the maximum ratio between the decompressed and the
+	// compressed size of a file, 0 for no limit. It is only checked
+	// past the first MiB of decompressed data.
+	MaxRatio float64
+	// RejectUnsafePaths aborts unpacking with an error matching
+	// ErrorUnsafePath on an entry whose name is absolute or escapes
+	// the archive, instead of skipping the entry.
+	RejectUnsafePaths bool
+	// Password decrypts the encrypted entries of zip archives, either
+	// ZipCrypto or AES ones.
+	Password string
+	// MaxDepth is how many levels of archives nested within an archive
+	// are unpacked as well, 0 to only unpack the outer one. The files of
+	// a nested archive are named after the archive, like
+	// "inner.tar.gz/file.yaml" for an archive in the fetched one. All
+	// levels share the same limits.
+	MaxDepth int
+}
+
+// DefaultUnpackOptions are the UnpackOptions of a new ARL.
+var DefaultUnpackOptions = UnpackOptions{
+	MaxEntries: 100000,
+	MaxSize:    256 * 1024 * 1024,
+	MaxRatio:   200,
+}
+
+// minRatioCheckSize is the decompressed size below which MaxRatio is not
+// enforced, small but very repetitive files are common and harmless.
+const minRatioCheckSize = 1024 * 1024
+
+// unpackBudget enforces the UnpackOptions while unpacking an archive.
+type unpackBudget struct {
+	opts    UnpackOptions
+	entries int
+	size    uint64
+	// err is set once a limit has been exceeded.
+	err error
+}
+
+func newUnpackBudget(opts UnpackOptions, maxSize uint64) *unpackBudget {
+	if maxSize != 0 && (opts.MaxSize == 0 || maxSize < opts.MaxSize) {
+		opts.MaxSize = maxSize
+	}
+	return &unpackBudget{
+		opts: opts,
+	}
+}
+
+func (b *unpackBudget) addEntry() error {
+	b.entries++
+	if b.opts.MaxEntries != 0 && b.entries > b.opts.MaxEntries {
+		b.err = fmt.Errorf("%w: more than %d files", ErrorArchiveLimitExceeded, b.opts.MaxEntries)
+	}
+	return b.err
+}
+
+// reader charges the data read from r against the budget, r being the
+// decompressed form of the bytes counted by compressedSize.
+func (b *unpackBudget) reader(r io.Reader, compressedSize func() uint64) io.Reader {
+	return &unpackReader{
+		Reader:         r,
+		budget:         b,
+		compressedSize: compressedSize,
+	}
+}
+
+type unpackReader struct {
+	io.Reader
+	budget         *unpackBudget
+	compressedSize func() uint64
+	read           uint64
+}
+
+func (r *unpackReader) Read(p []byte) (int, error) {
+	if r.budget.err != nil {
+		return 0, r.budget.err
+	}
+	n, err := r.Reader.Read(p)
+	r.read += uint64(n)
+	r.budget.size += uint64(n)
+	opts := r.budget.opts
+	if opts.MaxSize != 0 && r.budget.size > opts.MaxSize {
+		r.budget.err = withKind(ErrorArchiveLimitExceeded, errMaxSize(opts.MaxSize))
+		return n, r.budget.err
+	}
+	if opts.MaxRatio != 0 && r.read > minRatioCheckSize && float64(r.read) > opts.MaxRatio*float64(max(r.compressedSize(), 1)) {
+		r.budget.err = fmt.Errorf("%w: compression ratio above %v", ErrorArchiveLimitExceeded, opts.MaxRatio)
+		return n, r.budget.err
+	}
+	return n, err
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	io.Reader
+	n uint64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.n += uint64(n)
+	return n, err
+}
+
+func (r *countingReader) count() uint64 {
+	return r.n
+}
+
+// cleanEntryName returns the cleaned, relative form of the name of an
+// archive entry, or an error if the name cannot safely be used as a path.
+// Backslashes are treated as separators since some archivers use them.
+func cleanEntryName(name string) (string, error) {
+	if strings.ContainsRune(name, 0) {
+		return "", fmt.Errorf("%w: %q contains a NUL byte", ErrorUnsafePath, name)
+	}
+	slashed := strings.ReplaceAll(name, "\\", "/")
+	if strings.HasPrefix(slashed, "/") {
+		return "", fmt.Errorf("%w: %q is absolute", ErrorUnsafePath, name)
+	}
+	if len(slashed) >= 2 && slashed[1] == ':' && ('a' <= slashed[0]|0x20 && slashed[0]|0x20 <= 'z') {
+		return "", fmt.Errorf("%w: %q has a drive letter", ErrorUnsafePath, name)
+	}
+	cleaned := path.Clean(slashed)
+	if cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", fmt.Errorf("%w: %q escapes the archive", ErrorUnsafePath, name)
+	}
+	if cleaned == "." {
+		return "", fmt.Errorf("%w: %q is empty", ErrorUnsafePath, name)
+	}
+	return cleaned, nil
+}
+
+// entryPath returns the FilePath of an archive entry. If the name is not
+// safe, skip is true when the entry should be skipped, otherwise err
+// should abort unpacking.
+func entryPath(name string, opts UnpackOptions) (filePath string, skip bool, err error) {
+	cleaned, err := cleanEntryName(name)
+	if err != nil {
+		if opts.RejectUnsafePaths {
+			return "", false, err
+		}
+		return "", true, nil
+	}
+	return cleaned, false, nil
+}
+
+// joinPath returns the FilePath of the file at name in an archive whose
+// files are named under prefix.
+func joinPath(prefix string, name string) string {
+	if prefix == "" {
+		return name
+	}
+	return prefix + "/" + name
+}
+
+// compression describes a compression format recognized when unpacking.
+type compression struct {
+	name  string
+	magic []byte
+	// match, if set, further checks the start of the data when the magic
+	// is too short to be told apart from plain text.
+	match     func(data []byte) bool
+	extension string
+	newReader func(r io.Reader) (io.ReadCloser, error)
+}
+
+// bzip2Magics are the magics of the first block of a bzip2 stream and of
+// the end of an empty one.
+var bzip2Magics = [][]byte{
+	{0x31, 0x41, 0x59, 0x26, 0x53, 0x59},
+	{0x17, 0x72, 0x45, 0x38, 0x50, 0x90},
+}
+
+var compressions = []compression{
+	{
+		name:      "gzip",
+		magic:     []byte{0x1f, 0x8b},
+		extension: ".gz",
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		},
+	},
+	{
+		name:  "bzip2",
+		magic: []byte("BZh"),
+		// The block size digit and the magic of the first block
+		// follow "BZh".
+		match: func(data []byte) bool {
+			if len(data) < 10 || data[3] < '1' || data[3] > '9' {
+				return false
+			}
+			for _, magic := range bzip2Magics {
+				if bytes.Equal(data[4:10], magic) {
+					return true
+				}
+			}
+			return false
+		},
+		extension: ".bz2",
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			return io.NopCloser(bzip2.NewReader(r)), nil
+		},
+	},
+	{
+		name:      "xz",
+		magic:     []byte{0xfd, '7', 'z', 'X', 'Z', 0x00},
+		extension: ".xz",
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			xzReader, err := xz.NewReader(r)
+			if err != nil {
+				return nil, err
+			}
+			return io.NopCloser(xzReader), nil
+		},
+	},
+	{
+		name:      "zstd",
+		magic:     []byte{0x28, 0xb5, 0x2f, 0xfd},
+		extension: ".zst",
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			zstdReader, err := zstd.NewReader(r)
+			if err != nil {
+				return nil, err
+			}
+			return zstdReader.IOReadCloser(), nil
+		},
+	},
+}
+
+// detectCompression returns the compression of the data starting with
+// head based on its magic bytes, or nil if it is not compressed. Data whose
+// header does not decode is taken as not compressed, so that a plain file
+// which happens to start like a compressed one is still produced as-is.
+func detectCompression(head []byte) *compression {
+	for i := range compressions {
+		comp := &compressions[i]
+		if !bytes.HasPrefix(head, comp.magic) || (comp.match != nil && !comp.match(head)) {
+			continue
+		}
+		if !comp.decodesHeader(head) {
+			return nil
+		}
+		return comp
+	}
+	return nil
+}
+
+// decodesHeader reports whether the header at the start of head decodes,
+// head being possibly cut short of the rest of the data.
+func (c *compression) decodesHeader(head []byte) bool {
+	r, err := c.newReader(bytes.NewReader(head))
+	if err != nil {
+		return errors.Is(err, io.ErrUnexpectedEOF)
+	}
+	r.Close()
+	return true
+}
+
+// zipMagics are the signatures a zip archive can start with, the local
+// file header or, for an empty archive, the end of central directory.
+var zipMagics = [][]byte{
+	[]byte("PK\x03\x04"),
+	[]byte("PK\x05\x06"),
+}
+
+func isZip(data []byte) bool {
+	for _, magic := range zipMagics {
+		if bytes.HasPrefix(data, magic) {
+			return true
+		}
+	}
+	return false
+}
+
+const tarBlockSize = 512
+
+// isTarHeader reports whether block is a valid tar header, which is only
+// the case if its checksum matches.
+func isTarHeader(block []byte) bool {
+	if len(block) < tarBlockSize {
+		return false
+	}
+	expected, err := strconv.ParseUint(strings.Trim(string(block[148:156]), " \x00"), 8, 64)
+	if err != nil {
+		return false
+	}
+	// The checksum is computed with its own field set to spaces.
+	sum := uint64(0)
+	for i, b := range block[:tarBlockSize] {
+		if 148 <= i && i < 156 {
+			b = ' '
+		}
+		sum += uint64(b)
+	}
+	return sum == expected
+}
+
+// shouldUnpack reports whether a resource is to be unpacked according to
+// mode, isSingle being the choice of the method for UnpackSingle.
+func shouldUnpack(mode UnpackMode, isSingle bool) bool {
+	switch mode {
+	case UnpackNever:
+		return false
+	case UnpackAlways:
+		return true
+	}
+	return isSingle
+}
+
+// unpackStreams unpacks the resources of chIn selected by opts. Each file
+// of an archive is produced as soon as it is reached in the resource's
+// stream, the next one is only read once it has been closed. The MaxSize of
+// opts is lowered to maxSize if set. The files unpacked are selected by
+// filter.
+func unpackStreams(ctx context.Context, chIn chan StreamContent, opts UnpackOptions, maxSize uint64, filter Filter) chan StreamContent {
+	if opts.Mode == UnpackNever {
+		return chIn
+	}
+	chOut := make(chan StreamContent, cap(chIn))
+
+	go func() {
+		defer close(chOut)
+		for s := range chIn {
+			if s.Error != nil || s.Reader == nil || !shouldUnpack(opts.Mode, s.Unpack) {
+				if !sendStream(ctx, chOut, s) {
+					break
+				}
+				continue
+			}
+			// The resources of multi-file sources are only unpacked
+			// when forced, their files are then named after the
+			// archive to keep them apart.
+			prefix := ""
+			if !s.Unpack {
+				prefix = s.FilePath
+			}
+			u := unpacker{
+				budget: newUnpackBudget(opts, maxSize),
+				filter: filter,
+				root:   prefix,
+				source: s.SourceURI,
+				emit: func(e StreamContent) bool {
+					if e.Reader == nil {
+						return sendStream(ctx, chOut, e)
+					}
+					entry := newEntryReader(e.Reader)
+					e.Reader = entry
+					return sendStream(ctx, chOut, e) && entry.wait(ctx)
+				},
+			}
+			u.unpack(s, prefix, 0)
+			if ctx.Err() != nil {
+				break
+			}
+		}
+		for s := range chIn {
+			if s.Reader != nil {
+				s.Reader.Close()
+			}
+		}
+	}()
+
+	return chOut
+}
+
+// unpacker unpacks a resource, handing its files over to emit one at a
+// time. When emit returns, the reader of the file it was given may no
+// longer be used, emit returns false to stop unpacking.
+type unpacker struct {
+	budget *unpackBudget
+	emit   func(s StreamContent) bool
+	filter Filter
+	// root is the prefix of the files of the outermost archive and
+	// source its SourceURI.
+	root   string
+	source string
+}
+
+// sourceURI returns the SourceURI of the file of the archive at filePath.
+func (u *unpacker) sourceURI(filePath string) string {
+	return u.source + "#" + strings.TrimPrefix(strings.TrimPrefix(filePath, u.root), "/")
+}
+
+// unpack produces s, or its files if it is an archive, in which case the
+// files are named by their path in the archive under prefix. Compressed
+// content is decompressed first, so compressed tarballs get unpacked and
+// other compressed files are produced decompressed. The archives nested in
+// s are unpacked as well down to opts.MaxDepth. The reader of s is closed
+// when done, false is returned once unpacking must stop altogether.
+func (u *unpacker) unpack(s StreamContent, prefix string, depth int) bool {
+	defer s.Reader.Close()
+	reader := bufio.NewReaderSize(s.Reader, tarBlockSize)
+
+	// Only what is already buffered is looked at past the magic, the
+	// rest of the data may not be sent before this file is consumed.
+	reader.Peek(16)
+	head, _ := reader.Peek(reader.Buffered())
+	if comp := detectCompression(head); comp != nil {
+		compressed := &countingReader{Reader: reader}
+		decompressor, err := comp.newReader(compressed)
+		if err != nil {
+			return u.fail(s.FilePath, fmt.Errorf("failed to decompress %s content: %w", comp.name, err))
+		}
+		defer decompressor.Close()
+		reader = bufio.NewReaderSize(u.budget.reader(decompressor, compressed.count), tarBlockSize)
+		s.FilePath = strings.TrimSuffix(s.FilePath, comp.extension)
+		// What the source said about the data no longer applies.
+		s.Size = -1
+		s.ContentType = ""
+		s.MD5 = nil
+	}
+
+	if block, err := reader.Peek(tarBlockSize); err == nil && isTarHeader(block) {
+		return u.unpackTar(tar.NewReader(reader), prefix, depth)
+	}
+
+	if magic, _ := reader.Peek(4); isZip(magic) {
+		// Zip needs random access, the archive has to be buffered.
+		data, err := io.ReadAll(reader)
+		if err != nil {
+			return u.fail(s.FilePath, err)
+		}
+		if zipReader, err := zip.NewReader(bytes.NewReader(data), int64(len(data))); err == nil {
+			return u.unpackZip(zipReader, prefix, depth)
+		}
+		// Not a valid zip after all.
+		reader = bufio.NewReader(bytes.NewReader(data))
+	}
+
+	// So this was not a tar and not a zip, we'll just return
+	// the file as-is.
+	if !u.filter.Match(s.FilePath) {
+		return u.budget.err == nil
+	}
+	s.Reader = io.NopCloser(reader)
+	return u.emit(s) && u.check(prefix)
+}
+
+// unpackEntry produces a file extracted from the archive at prefix and
+// depth, first unpacking it if it is itself an archive and opts.MaxDepth
+// allows it. The reader of s is closed when done.
+func (u *unpacker) unpackEntry(s StreamContent, prefix string, depth int) bool {
+	if !u.leaf(depth) {
+		return u.unpack(s, s.FilePath, depth+1)
+	}
+	defer s.Reader.Close()
+	return u.emit(s) && u.check(prefix)
+}
+
+// leaf reports whether the files of an archive at depth are produced
+// without being looked into.
+func (u *unpacker) leaf(depth int) bool {
+	return depth >= u.budget.opts.MaxDepth
+}
+
+// check aborts the unpacking of the archive at prefix if a limit was
+// exceeded while the last file was read, the file itself only gets the
+// error from its reader.
+func (u *unpacker) check(prefix string) bool {
+	if u.budget.err != nil {
+		return u.fail(prefix, u.budget.err)
+	}
+	return true
+}
+
+// fail produces an error aborting the unpacking.
+func (u *unpacker) fail(filePath string, err error) bool {
+	u.emit(StreamContent{
+		FilePath: filePath,
+		Metadata: Metadata{Size: -1},
+		Error:    err,
+	})
+	return false
+}
+
+func tarMetadata(header *tar.Header) Metadata {
+	return Metadata{
+		Size:    header.Size,
+		Mode:    header.FileInfo().Mode(),
+		ModTime: header.ModTime,
+	}
+}
+
+func (u *unpacker) unpackTar(tarReader *tar.Reader, prefix string, depth int) bool {
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return true
+		}
+		if err != nil {
+			return u.fail(prefix, fmt.Errorf("failed to read tar: %w", err))
+		}
+		// We only care about regular files.
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		filePath, skip, err := entryPath(header.Name, u.budget.opts)
+		if skip {
+			continue
+		}
+		if err != nil {
+			return u.fail(prefix, err)
+		}
+		filePath = joinPath(prefix, filePath)
+		if u.leaf(depth) && !u.filter.Match(filePath) {
+			continue
+		}
+		if err := u.budget.addEntry(); err != nil {
+			return u.fail(prefix, err)
+		}
+		// The tar data itself is not compressed, its size was already
+		// accounted for when it was fetched or decompressed.
+		if !u.unpackEntry(StreamContent{
+			FilePath:  filePath,
+			SourceURI: u.sourceURI(filePath),
+			Metadata:  tarMetadata(header),
+			Reader:    io.NopCloser(tarReader),
+		}, prefix, depth) {
+			return false
+		}
+	}
+}
+
+func (u *unpacker) unpackZip(zipReader *zip.Reader, prefix string, depth int) bool {
+	for _, zipFile := range zipReader.File {
+		if zipFile.FileInfo().IsDir() {
+			continue
+		}
+		filePath, skip, err := entryPath(zipFile.Name, u.budget.opts)
+		if skip {
+			continue
+		}
+		if err != nil {
+			return u.fail(prefix, err)
+		}
+		filePath = joinPath(prefix, filePath)
+		if u.leaf(depth) && !u.filter.Match(filePath) {
+			continue
+		}
+		if err := u.budget.addEntry(); err != nil {
+			return u.fail(prefix, err)
+		}
+		newFile := StreamContent{
+			FilePath:  filePath,
+			SourceURI: u.sourceURI(filePath),
+			Metadata: Metadata{
+				Size:    int64(zipFile.UncompressedSize64),
+				Mode:    zipFile.Mode(),
+				ModTime: zipFile.Modified,
+			},
+		}
+		f, err := openZipFile(zipFile, u.budget.opts.Password)
+		if err != nil {
+			newFile.Error = err
+			if !u.emit(newFile) {
+				return false
+			}
+			continue
+		}
+		compressedSize := zipFile.CompressedSize64
+		newFile.Reader = &struct {
+			io.Reader
+			io.Closer
+		}{
+			Reader: u.budget.reader(f, func() uint64 { return compressedSize }),
+			Closer: f,
+		}
+		if !u.unpackEntry(newFile, prefix, depth) {
+			return false
+		}
+	}
+	return true
+}
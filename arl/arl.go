@@ -20,184 +20,261 @@
 package arl
 
 import (
-	"archive/tar"
-	"archive/zip"
-	"bytes"
+	"context"
 	"errors"
-	"fmt"
-	"io"
+	"io/fs"
+	"log/slog"
 	"net/http"
+	"path"
+	"slices"
 	"strings"
+	"time"
 )
 
 type AuthenticatedResourceLocator struct {
 	arl           string
 	maxSize       uint64
 	maxConcurrent uint64
+	maxFiles      uint64
 
 	methodName string
 	methodDest string
 	authType   string
 	authData   string
+	options    string
 
 	httpClient *http.Client
+	logger     *slog.Logger
 
-	get func() (chan Content, error)
+	githubAPIURL      string
+	githubCodeloadURL string
+
+	unpackOptions UnpackOptions
+	filter        Filter
+
+	method Method
 }
 
 type Content struct {
+	// FilePath is the path of the file relative to the ARL destination,
+	// slash separated and without leading slash. A destination which is
+	// a single file gives its base name, the files of an archive are
+	// named by their path in the archive, under the archive's own path
+	// when it is one of several resources.
 	FilePath string
-	Data     []byte
-	Error    error
+	// SourceURI locates the resource the file came from, with any
+	// credentials removed. The files of an archive are located with the
+	// archive's URI followed by "#" and their path in the archive.
+	SourceURI string
+	Data      []byte
+	Error     error
+	Metadata
+}
+
+// relativePath returns the FilePath of the file at name in a source where
+// the destination is at dest, dest being a prefix of name.
+func relativePath(name string, dest string) string {
+	switch {
+	case name == dest:
+		return path.Base(name)
+	case dest == "" || strings.HasSuffix(dest, "/"):
+		return name[len(dest):]
+	case strings.HasPrefix(name, dest+"/"):
+		return name[len(dest)+1:]
+	}
+	// The destination is only a prefix of the file name, like "dir"
+	// for "dir2/file", the path is taken from the parent directory.
+	if dir := path.Dir(dest); dir != "." {
+		return strings.TrimPrefix(name, dir+"/")
+	}
+	return name
+}
+
+// Metadata describes a fetched file as far as its source tells, the
+// fields the source does not provide are left to their zero value.
+type Metadata struct {
+	// Size is the size of the data in bytes, or -1 if it is not known
+	// before reading.
+	Size int64
+	// Mode holds the type and permission bits of the file, like the
+	// executable bit of the files of a git repo or an archive.
+	Mode    fs.FileMode
+	ModTime time.Time
+	// Version identifies the revision of the file at its source: the
+	// generation of a GCS object, the hash of a git blob or the ETag of
+	// an HTTP resource.
+	Version     string
+	ContentType string
+	// MD5 is the hash of the data as reported by the source.
+	MD5 []byte
 }
 
 var ErrorMethodNotImplemented = errors.New("method not implemented")
 var ErrorAuthNotImplemented = errors.New("auth not implemented")
 var ErrorInvalidFormat = errors.New("invalid ARL format")
 var ErrorResourceNotFound = errors.New("resource not found")
+var ErrorMaxSizeExceeded = errors.New("maximum resource size reached")
+var ErrorMaxFilesExceeded = errors.New("maximum number of files reached")
+var ErrorUnauthorized = errors.New("unauthorized")
+var ErrorRateLimited = errors.New("rate limited")
+var ErrorArchiveLimitExceeded = errors.New("archive limits exceeded")
+var ErrorUnsafePath = errors.New("unsafe path in archive")
+var ErrorInvalidPassword = errors.New("invalid archive password")
 
-var supportedMethods = map[string]map[string]bool{
-	"http": {
-		"basic":  true,
-		"bearer": true,
-		"token":  true,
-		"otx":    true,
-		"":       true,
-	},
-	"https": {
-		"basic":  true,
-		"bearer": true,
-		"token":  true,
-		"otx":    true,
-		"":       true,
-	},
-	"gcs": {
-		"gaia": true,
-	},
-	"github": {
-		"token": true,
-		"ssh":   true,
-		"":      true,
-	},
-}
+// defaultMaxConcurrent is the number of concurrent requests of the ARLs
+// created by New without WithMaxConcurrent.
+const defaultMaxConcurrent = 4
 
-func NewARLWithClient(arl string, maxSize uint64, maxConcurrent uint64, client *http.Client) (AuthenticatedResourceLocator, error) {
+// New creates the AuthenticatedResourceLocator for an ARL string. Without
+// options, the size fetched is unlimited and up to 4 concurrent requests
+// are made with http.DefaultClient.
+func New(arl string, opts ...Option) (AuthenticatedResourceLocator, error) {
 	a := AuthenticatedResourceLocator{
 		arl:           arl,
-		maxSize:       maxSize,
-		maxConcurrent: maxConcurrent,
-		httpClient:    client,
+		maxConcurrent: defaultMaxConcurrent,
+		httpClient:    http.DefaultClient,
+		logger:        slog.New(slog.DiscardHandler),
+
+		githubAPIURL:      DefaultGitHubAPIURL,
+		githubCodeloadURL: DefaultGitHubCodeloadURL,
+		unpackOptions:     DefaultUnpackOptions,
 	}
 
-	if strings.HasPrefix(arl, "https://") {
-		// This is a shortcut for backwards compatibility.
-		a.methodName = "https"
-		a.methodDest = arl[len("https://"):]
-	} else if strings.HasPrefix(arl, "[") && strings.HasSuffix(arl, "]") {
-		// Remove prefix and suffix.
-		arl = arl[1 : len(arl)-1]
-		// Split the ARL into its components.
-		components := strings.Split(arl, ",")
-		if len(components) != 4 && len(components) != 2 {
-			return a, ErrorInvalidFormat
-		}
-		// Remove any unneeded spaces.
-		for i := range components {
-			components[i] = strings.TrimSpace(components[i])
-		}
-		// Load the components in order.
-		a.methodName = strings.ToLower(components[0])
-		a.methodDest = components[1]
-		if len(components) == 4 {
-			a.authType = strings.ToLower(components[2])
-			a.authData = components[3]
-		}
-	} else {
-		return a, ErrorInvalidFormat
+	parsed, err := Parse(arl)
+	if err != nil {
+		return a, err
+	}
+	a.methodName = parsed.Method
+	a.methodDest = parsed.Destination
+	a.authType = parsed.AuthType
+	a.authData = parsed.AuthData
+	a.options = parsed.Options
+	if a.filter, err = parsed.Filter(); err != nil {
+		return a, err
 	}
 
 	// Validate the method is supported.
-	if _, ok := supportedMethods[a.methodName]; !ok {
+	method, ok := getMethod(a.methodName)
+	if !ok {
 		return a, ErrorMethodNotImplemented
 	}
 	// Validate the method supports the auth.
-	if _, ok := supportedMethods[a.methodName][a.authType]; !ok {
+	if !slices.Contains(method.AuthTypes(), a.authType) {
 		return a, ErrorAuthNotImplemented
 	}
+	a.method = method
 
-	// Resolve the relevant callback for this method.
-	a.get = map[string]func() (chan Content, error){
-		"http":   a.getHTTP,
-		"https":  a.getHTTP,
-		"gcs":    a.getGCS,
-		"github": a.getGitHub,
-	}[a.methodName]
+	// The options come last so that they override the ARL options.
+	for _, opt := range opts {
+		if err := opt(&a); err != nil {
+			return a, err
+		}
+	}
 
 	return a, nil
 }
 
+func NewARLWithClient(arl string, maxSize uint64, maxConcurrent uint64, client *http.Client) (AuthenticatedResourceLocator, error) {
+	return New(arl, WithMaxSize(maxSize), WithMaxConcurrent(maxConcurrent), WithHTTPClient(client))
+}
+
 func NewARL(arl string, maxSize uint64, maxConcurrent uint64) (AuthenticatedResourceLocator, error) {
-	return NewARLWithClient(arl, maxSize, maxConcurrent, http.DefaultClient)
+	return New(arl, WithMaxSize(maxSize), WithMaxConcurrent(maxConcurrent))
+}
+
+// ARL returns the structured form of the ARL being fetched.
+func (a AuthenticatedResourceLocator) ARL() ARL {
+	return ARL{
+		Method:      a.methodName,
+		Destination: a.methodDest,
+		AuthType:    a.authType,
+		AuthData:    a.authData,
+		Options:     a.options,
+	}
+}
+
+// MaxSize returns the maximum number of bytes to fetch, 0 if unlimited.
+func (a AuthenticatedResourceLocator) MaxSize() uint64 {
+	return a.maxSize
+}
+
+// MaxConcurrent returns the maximum number of concurrent requests to use.
+func (a AuthenticatedResourceLocator) MaxConcurrent() uint64 {
+	return a.maxConcurrent
+}
+
+// HTTPClient returns the client to use for HTTP requests.
+func (a AuthenticatedResourceLocator) HTTPClient() *http.Client {
+	return a.httpClient
+}
+
+// MaxFiles returns the maximum number of files to fetch, 0 if unlimited.
+func (a AuthenticatedResourceLocator) MaxFiles() uint64 {
+	return a.maxFiles
+}
+
+// Logger returns the logger the fetches report to.
+func (a AuthenticatedResourceLocator) Logger() *slog.Logger {
+	return a.logger
+}
+
+// SetUnpackOptions changes how Fetch unpacks archives.
+func (a *AuthenticatedResourceLocator) SetUnpackOptions(opts UnpackOptions) {
+	a.unpackOptions = opts
+}
+
+// Filter returns the Filter selecting the files to fetch.
+func (a AuthenticatedResourceLocator) Filter() Filter {
+	return a.filter
+}
+
+// SetFilter replaces the Filter given in the ARL options.
+func (a *AuthenticatedResourceLocator) SetFilter(f Filter) error {
+	if err := f.Validate(); err != nil {
+		return err
+	}
+	a.filter = f
+	return nil
 }
 
 func (a *AuthenticatedResourceLocator) Fetch() (chan Content, error) {
-	return a.get()
-}
-
-func multiplexContent(c Content) chan Content {
-	out := make(chan Content, 1)
-
-	go func() {
-		defer close(out)
-
-		tarReader := tar.NewReader(bytes.NewReader(c.Data))
-		for {
-			header, err := tarReader.Next()
-			if err == io.EOF {
-				return
-			}
-			if err != nil {
-				break
-			}
-			// We only care about regular files.
-			if header.Typeflag != tar.TypeReg {
-				continue
-			}
-			newData := bytes.Buffer{}
-			_, err = io.Copy(&newData, tarReader)
-			out <- Content{
-				FilePath: fmt.Sprintf("/%s", header.Name),
-				Data:     newData.Bytes(),
-				Error:    err,
-			}
-		}
+	return a.FetchContext(context.Background())
+}
 
-		zipReader, err := zip.NewReader(bytes.NewReader(c.Data), int64(len(c.Data)))
-		if err != nil {
-			// So this was not a tar and not a zip, we'll just return
-			// the file as-is.
-			out <- c
-			return
-		}
-		for _, zipFile := range zipReader.File {
-			newData := bytes.Buffer{}
-			newFile := Content{
-				FilePath: fmt.Sprintf("/%s", zipFile.Name),
-			}
-			f, err := zipFile.Open()
-			if err != nil {
-				newFile.Error = err
-			} else {
-				_, err = io.Copy(&newData, f)
-			}
-			if err != nil {
-				newFile.Error = err
-			} else {
-				newFile.Data = newData.Bytes()
-			}
-			out <- newFile
-		}
-	}()
+// FetchContext is like Fetch but ties the whole fetch to ctx. Cancelling
+// ctx aborts any in-flight network I/O and makes every producer goroutine
+// exit, after which the returned channel is closed. The last Content
+// received may carry the context error, but it is dropped when the channel
+// is full: once the channel is closed, check ctx.Err() to tell a cancelled
+// fetch from a complete one.
+func (a *AuthenticatedResourceLocator) FetchContext(ctx context.Context) (chan Content, error) {
+	chIn, err := a.FetchStream(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return bufferContent(ctx, chIn, a.maxConcurrent), nil
+}
+
+// sendContent delivers c on ch unless ctx is done first, in which case it
+// returns false and the caller should stop producing.
+func sendContent(ctx context.Context, ch chan<- Content, c Content) bool {
+	select {
+	case ch <- c:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
 
-	return out
+// finishContent closes ch. If ctx was cancelled, the context error is
+// offered to the consumer first if there is room for it in ch, the
+// consumer is not waited for.
+func finishContent(ctx context.Context, ch chan Content) {
+	if err := ctx.Err(); err != nil {
+		select {
+		case ch <- Content{Error: err}:
+		default:
+		}
+	}
+	close(ch)
 }
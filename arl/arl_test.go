@@ -20,8 +20,32 @@
 package arl
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+	"go.uber.org/goleak"
 )
 
 func TestValidation(t *testing.T) {
@@ -34,10 +58,816 @@ func TestValidation(t *testing.T) {
 	}
 }
 
+func TestParse(t *testing.T) {
+	a, err := Parse("[HTTPS, my.corpwebsite.com/resourdata ,Basic,myusername:mypassword]")
+	if err != nil {
+		t.Fatalf("failed parsing ARL: %v", err)
+	}
+	expected := ARL{
+		Method:      "https",
+		Destination: "my.corpwebsite.com/resourdata",
+		AuthType:    "basic",
+		AuthData:    "myusername:mypassword",
+	}
+	if a != expected {
+		t.Errorf("unexpected parsed ARL: %#v", a)
+	}
+	if a.String() != "[https,my.corpwebsite.com/resourdata,basic,myusername:mypassword]" {
+		t.Errorf("unexpected serialized ARL: %s", a.String())
+	}
+
+	for _, s := range []string{
+		"[https,my.corpwebsite.com/resourdata]",
+		"[github,my-org/my-repo-name,token,bfuihferhf8erh7ubhfey7g3y4bfurbfhrb]",
+	} {
+		a, err := Parse(s)
+		if err != nil {
+			t.Errorf("failed parsing %s: %v", s, err)
+		}
+		if a.String() != s {
+			t.Errorf("ARL did not round trip: %s != %s", a.String(), s)
+		}
+	}
+
+	a, err = Parse("https://my.corpwebsite.com/resourdata")
+	if err != nil {
+		t.Errorf("failed parsing https shortcut: %v", err)
+	}
+	if a.String() != "[https,my.corpwebsite.com/resourdata]" {
+		t.Errorf("unexpected serialized https shortcut: %s", a.String())
+	}
+
+	for _, s := range []string{"", "[https]", "[https,a,b]", "https,a"} {
+		if _, err := Parse(s); !errors.Is(err, ErrorInvalidFormat) {
+			t.Errorf("invalid ARL %q failed to produce error: %v", s, err)
+		}
+	}
+}
+
+func TestParseEscaping(t *testing.T) {
+	a, err := Parse(`[https,my.corpwebsite.com/a\,b,basic,user:pa\,ss\]wo\\rd]`)
+	if err != nil {
+		t.Fatalf("failed parsing escaped ARL: %v", err)
+	}
+	if a.Destination != "my.corpwebsite.com/a,b" || a.AuthData != `user:pa,ss]wo\rd` {
+		t.Errorf("unexpected unescaped ARL: %#v", a)
+	}
+
+	expected := ARL{
+		Method:      "gcs",
+		Destination: "bucket/[prefix],x",
+		AuthType:    "gaia",
+		AuthData:    `a\b,c]`,
+	}
+	a, err = Parse(expected.String())
+	if err != nil {
+		t.Fatalf("failed parsing serialized ARL %s: %v", expected.String(), err)
+	}
+	if a != expected {
+		t.Errorf("ARL did not round trip: %#v", a)
+	}
+
+	// Whitespace at the edges of a component is escaped to be kept.
+	for _, authData := range []string{" token ", "to ken", " ", `a\ `, "tok\t", "\nx", "\r\n", "a\u00a0", "\xffx\t"} {
+		expected.AuthData = authData
+		a, err = Parse(expected.String())
+		if err != nil || a != expected {
+			t.Errorf("ARL with auth data %q did not round trip: %s, %v", authData, expected.String(), err)
+		}
+	}
+	if a, err = Parse(`[gcs, bucket ,gaia,\ token\ ]`); err != nil || a.Destination != "bucket" || a.AuthData != " token " {
+		t.Errorf("unexpected escaped spaces: %#v, %v", a, err)
+	}
+
+	// Backslashes not followed by a special character are literal.
+	a, err = Parse(`[https,my.corpwebsite.com/C:\path,token,ab\cd]`)
+	if err != nil {
+		t.Fatalf("failed parsing unescaped ARL: %v", err)
+	}
+	if a.Destination != `my.corpwebsite.com/C:\path` || a.AuthData != `ab\cd` {
+		t.Errorf("unexpected unescaped ARL: %#v", a)
+	}
+}
+
+func TestRedaction(t *testing.T) {
+	a, err := NewARL("[https,user:hunter2@my.corpwebsite.com/resourdata?key=hunter2,bearer,hunter2]", 1024, 3)
+	if err != nil {
+		t.Fatalf("failed creating https ARL: %v", err)
+	}
+
+	logs := bytes.Buffer{}
+	slog.New(slog.NewJSONHandler(&logs, nil)).Info("fetching", "arl", a)
+
+	for _, s := range []string{
+		fmt.Sprintf("%v", a),
+		fmt.Sprintf("%+v", a),
+		fmt.Sprintf("%#v", a),
+		fmt.Sprintf("%v", &a),
+		fmt.Sprintf("%#v", a.ARL()),
+		a.ARL().Redacted(),
+		Redact("[gcs,bucket,gaia,hunter2]"),
+		Redact("[https,broken,hunter2"),
+		logs.String(),
+	} {
+		if strings.Contains(s, "hunter2") {
+			t.Errorf("secret leaked: %s", s)
+		}
+	}
+
+	if r := a.String(); r != "[https,my.corpwebsite.com/resourdata,bearer,<redacted>]" {
+		t.Errorf("unexpected redacted ARL: %s", r)
+	}
+	// The ARL itself formats in full, for tools rewriting configurations.
+	if b, err := Parse(fmt.Sprint(a.ARL())); err != nil || b != a.ARL() {
+		t.Errorf("full ARL is not available: %v", err)
+	}
+}
+
+type staticMethod map[string]string
+
+func (m staticMethod) AuthTypes() []string {
+	return []string{""}
+}
+
+func (m staticMethod) Fetch(ctx context.Context, a AuthenticatedResourceLocator) (chan StreamContent, error) {
+	chOut := make(chan StreamContent, len(m))
+	for name, data := range m {
+		chOut <- StreamContent{
+			FilePath:  name,
+			SourceURI: a.ARL().Destination + "/" + name,
+			Metadata:  Metadata{Size: int64(len(data))},
+			Reader:    io.NopCloser(strings.NewReader(data)),
+		}
+	}
+	close(chOut)
+	return chOut, nil
+}
+
+func TestRegisterMethod(t *testing.T) {
+	RegisterMethod("Static", staticMethod{"a": "aaa", "b": "bbb"})
+
+	if _, err := NewARL("[static,root,token,aaa]", 1024, 3); !errors.Is(err, ErrorAuthNotImplemented) {
+		t.Errorf("unsupported auth failed to produce error: %v", err)
+	}
+
+	a, err := NewARL("[static,root]", 1024, 3)
+	if err != nil {
+		t.Fatalf("failed creating static ARL: %v", err)
+	}
+	ch, err := a.Fetch()
+	if err != nil {
+		t.Fatalf("failed fetching static ARL: %v", err)
+	}
+	contents := map[string]string{}
+	for c := range ch {
+		if c.Error != nil {
+			t.Errorf("unexpected error fetching static ARL: %v", c.Error)
+		}
+		contents[c.FilePath] = string(c.Data)
+	}
+	if len(contents) != 2 || contents["a"] != "aaa" || contents["b"] != "bbb" {
+		t.Errorf("unexpected contents: %v", contents)
+	}
+}
+
+func makeTar(t *testing.T, files map[string]string) []byte {
+	b := bytes.Buffer{}
+	w := tar.NewWriter(&b)
+	for name, data := range files {
+		if err := w.WriteHeader(&tar.Header{
+			Name:     name,
+			Mode:     0644,
+			Size:     int64(len(data)),
+			Typeflag: tar.TypeReg,
+		}); err != nil {
+			t.Fatalf("failed writing tar header: %v", err)
+		}
+		if _, err := io.WriteString(w, data); err != nil {
+			t.Fatalf("failed writing tar data: %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("failed closing tar: %v", err)
+	}
+	return b.Bytes()
+}
+
+// serveFiles serves the given paths and returns the http destination of
+// the server.
+func serveFiles(t *testing.T, files map[string][]byte) string {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, ok := files[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(data)
+	}))
+	t.Cleanup(srv.Close)
+	return strings.TrimPrefix(srv.URL, "http://")
+}
+
+func fetchAll(t *testing.T, arl string) map[string]string {
+	a, err := NewARL(arl, 1024*1024, 3)
+	if err != nil {
+		t.Fatalf("failed creating ARL %s: %v", arl, err)
+	}
+	ch, err := a.Fetch()
+	if err != nil {
+		t.Fatalf("failed fetching ARL %s: %v", arl, err)
+	}
+	contents := map[string]string{}
+	for c := range ch {
+		if c.Error != nil {
+			t.Errorf("unexpected error fetching %s: %v", arl, c.Error)
+			continue
+		}
+		contents[c.FilePath] = string(c.Data)
+	}
+	return contents
+}
+
+func TestCompressedArchives(t *testing.T) {
+	files := map[string]string{"a.yaml": "aaa", "dir/b.yaml": "bbb"}
+	tarData := makeTar(t, files)
+
+	gzData := bytes.Buffer{}
+	gzWriter := gzip.NewWriter(&gzData)
+	gzWriter.Write(tarData)
+	gzWriter.Close()
+
+	xzData := bytes.Buffer{}
+	xzWriter, err := xz.NewWriter(&xzData)
+	if err != nil {
+		t.Fatalf("failed creating xz writer: %v", err)
+	}
+	xzWriter.Write(tarData)
+	xzWriter.Close()
+
+	zstdEncoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatalf("failed creating zstd writer: %v", err)
+	}
+	zstdData := zstdEncoder.EncodeAll(tarData, nil)
+
+	singleGz := bytes.Buffer{}
+	gzWriter = gzip.NewWriter(&singleGz)
+	io.WriteString(gzWriter, "just a file")
+	gzWriter.Close()
+
+	bzip2Data, err := os.ReadFile(filepath.Join("testdata", "rules.tar.bz2"))
+	if err != nil {
+		t.Fatalf("failed reading test archive: %v", err)
+	}
+
+	host := serveFiles(t, map[string][]byte{
+		"/rules.tar":     tarData,
+		"/rules.tar.gz":  gzData.Bytes(),
+		"/rules.tar.bz2": bzip2Data,
+		"/rules.tar.xz":  xzData.Bytes(),
+		"/rules.tar.zst": zstdData,
+		"/file.txt.gz":   singleGz.Bytes(),
+		"/notes.txt":     []byte("BZh is how the notes start"),
+	})
+
+	for _, name := range []string{"/rules.tar", "/rules.tar.gz", "/rules.tar.bz2", "/rules.tar.xz", "/rules.tar.zst"} {
+		contents := fetchAll(t, "[http,"+host+name+"]")
+		if len(contents) != 2 || contents["a.yaml"] != "aaa" || contents["dir/b.yaml"] != "bbb" {
+			t.Errorf("%s: unexpected contents: %v", name, contents)
+		}
+	}
+
+	contents := fetchAll(t, "[http,"+host+"/file.txt.gz]")
+	if contents["file.txt"] != "just a file" {
+		t.Errorf("unexpected decompressed contents: %v", contents)
+	}
+
+	// Plain files starting like a compressed one are produced as-is.
+	contents = fetchAll(t, "[http,"+host+"/notes.txt]")
+	if contents["notes.txt"] != "BZh is how the notes start" {
+		t.Errorf("unexpected plain contents: %v", contents)
+	}
+}
+
+// listedMethod can list its resources, fetching them is an error.
+type listedMethod []Entry
+
+func (m listedMethod) AuthTypes() []string {
+	return []string{""}
+}
+
+func (m listedMethod) Fetch(ctx context.Context, a AuthenticatedResourceLocator) (chan StreamContent, error) {
+	return nil, errors.New("listed method fetched")
+}
+
+func (m listedMethod) List(ctx context.Context, a AuthenticatedResourceLocator) ([]Entry, error) {
+	return m, nil
+}
+
+func TestList(t *testing.T) {
+	host := serveFiles(t, map[string][]byte{
+		"/rules.tar": makeTar(t, map[string]string{"a.yaml": "aaa", "dir/b.yaml": "bb"}),
+	})
+	a, err := NewARL("[http,"+host+"/rules.tar]", 1024*1024, 3)
+	if err != nil {
+		t.Fatalf("failed creating http ARL: %v", err)
+	}
+	entries, err := a.List(context.Background())
+	if err != nil {
+		t.Fatalf("failed listing http ARL: %v", err)
+	}
+	sizes := map[string]int64{}
+	for _, e := range entries {
+		sizes[e.FilePath] = e.Size
+		if e.SourceURI != "http://"+host+"/rules.tar#"+e.FilePath {
+			t.Errorf("unexpected source of %s: %s", e.FilePath, e.SourceURI)
+		}
+	}
+	if len(sizes) != 2 || sizes["a.yaml"] != 3 || sizes["dir/b.yaml"] != 2 {
+		t.Errorf("unexpected entries: %v", sizes)
+	}
+
+	RegisterMethod("listed", listedMethod{
+		{FilePath: "a", Metadata: Metadata{Size: 1}},
+		{FilePath: "b", Metadata: Metadata{Size: 2}},
+	})
+	a, err = NewARL("[listed,root]", 1024, 3)
+	if err != nil {
+		t.Fatalf("failed creating listed ARL: %v", err)
+	}
+	entries, err = a.List(context.Background())
+	if err != nil {
+		t.Fatalf("failed listing listed ARL: %v", err)
+	}
+	if len(entries) != 2 || entries[0].FilePath != "a" || entries[1].Size != 2 {
+		t.Errorf("unexpected entries: %v", entries)
+	}
+}
+
+func TestFilter(t *testing.T) {
+	a, err := Parse(`[github,org/repo,token,aaa,include=**/*.{yaml\,yml}&exclude=tests/**]`)
+	if err != nil {
+		t.Fatalf("failed parsing ARL with options: %v", err)
+	}
+	f, err := a.Filter()
+	if err != nil {
+		t.Fatalf("failed getting filter: %v", err)
+	}
+	if len(f.Include) != 1 || f.Include[0] != "**/*.{yaml,yml}" || len(f.Exclude) != 1 || f.Exclude[0] != "tests/**" {
+		t.Errorf("unexpected filter: %#v", f)
+	}
+	if b, err := Parse(a.String()); err != nil || b != a {
+		t.Errorf("ARL with options did not round trip: %s", a.String())
+	}
+	for name, expected := range map[string]bool{
+		"a.yaml":         true,
+		"dir/b.yml":      true,
+		"tests/c.yaml":   false,
+		"dir/d.json":     false,
+		"tests/e/f.yaml": false,
+	} {
+		if f.Match(name) != expected {
+			t.Errorf("%s: unexpected match", name)
+		}
+	}
+	for _, s := range []string{"[https,a,include]", "[https,a,nope=1]", "[https,a,include=[a]"} {
+		if _, err := Parse(s); !errors.Is(err, ErrorInvalidFormat) {
+			t.Errorf("invalid options %q failed to produce error: %v", s, err)
+		}
+	}
+
+	host := serveFiles(t, map[string][]byte{
+		"/rules.tar": makeTar(t, map[string]string{"a.yaml": "aaa", "tests/b.yaml": "bbb", "c.txt": "ccc"}),
+	})
+	contents := fetchAll(t, "[http,"+host+"/rules.tar,include=**/*.yaml&exclude=tests/**]")
+	if len(contents) != 1 || contents["a.yaml"] != "aaa" {
+		t.Errorf("unexpected filtered contents: %v", contents)
+	}
+
+	b, err := NewARL("[http,"+host+"/rules.tar]", 1024*1024, 3)
+	if err != nil {
+		t.Fatalf("failed creating http ARL: %v", err)
+	}
+	if err := b.SetFilter(Filter{Include: []string{"[a"}}); err == nil {
+		t.Error("invalid pattern failed to produce error")
+	}
+	b.SetUnpackOptions(UnpackOptions{Mode: UnpackNever})
+	b.SetFilter(Filter{Exclude: []string{"*.tar"}})
+	if _, err := b.FetchContext(context.Background()); !errors.Is(err, ErrorResourceNotFound) {
+		t.Errorf("filtered out resource failed to produce error: %v", err)
+	}
+
+	// A fetch left without any file is an error whatever the unpack mode.
+	host = serveFiles(t, map[string][]byte{
+		"/rules.tar": makeTar(t, map[string]string{"a.yaml": "aaa"}),
+		"/notes.txt": []byte("notes"),
+	})
+	for _, arl := range []string{"[http," + host + "/rules.tar,include=*.json]", "[http," + host + "/notes.txt,include=*.json]"} {
+		a, err := New(arl)
+		if err != nil {
+			t.Fatalf("failed creating http ARL: %v", err)
+		}
+		isErrorSeen := false
+		for _, err := range a.All(context.Background()) {
+			if errors.Is(err, ErrorResourceNotFound) {
+				isErrorSeen = true
+			}
+		}
+		if !isErrorSeen {
+			t.Errorf("%s: empty fetch failed to produce error", arl)
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	host := serveFiles(t, map[string][]byte{
+		"/rules.tar": makeTar(t, map[string]string{"a": "a", "b": "b", "c": "c"}),
+	})
+
+	a, err := New("[http," + host + "/rules.tar,bearer,hunter2]")
+	if err != nil {
+		t.Fatalf("failed creating http ARL: %v", err)
+	}
+	if a.MaxSize() != 0 || a.MaxConcurrent() != defaultMaxConcurrent || a.HTTPClient() != http.DefaultClient {
+		t.Errorf("unexpected defaults: %#v", a)
+	}
+
+	logs := bytes.Buffer{}
+	client := &http.Client{}
+	a, err = New("[http,"+host+"/rules.tar,bearer,hunter2]",
+		WithMaxSize(1024*1024),
+		WithMaxConcurrent(2),
+		WithHTTPClient(client),
+		WithLogger(slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))),
+		WithMaxFiles(2),
+	)
+	if err != nil {
+		t.Fatalf("failed creating http ARL: %v", err)
+	}
+	if a.MaxSize() != 1024*1024 || a.MaxConcurrent() != 2 || a.HTTPClient() != client || a.MaxFiles() != 2 {
+		t.Errorf("options not applied: %#v", a)
+	}
+	ch, err := a.Fetch()
+	if err != nil {
+		t.Fatalf("failed fetching http ARL: %v", err)
+	}
+	nFiles := 0
+	var lastErr error
+	for c := range ch {
+		if c.Error != nil {
+			lastErr = c.Error
+			continue
+		}
+		nFiles++
+	}
+	if nFiles != 2 || !errors.Is(lastErr, ErrorMaxFilesExceeded) {
+		t.Errorf("max files not enforced: %d files, %v", nFiles, lastErr)
+	}
+	if !strings.Contains(logs.String(), "fetching") || strings.Contains(logs.String(), "hunter2") {
+		t.Errorf("unexpected logs: %s", logs.String())
+	}
+
+	if _, err := New("[http,"+host+"/rules.tar]", WithFilter(Filter{Include: []string{"[a"}})); err == nil {
+		t.Error("invalid filter failed to produce error")
+	}
+}
+
+func makeZip(t *testing.T, files map[string]string) []byte {
+	b := bytes.Buffer{}
+	w := zip.NewWriter(&b)
+	for name, data := range files {
+		f, err := w.Create(name)
+		if err != nil {
+			t.Fatalf("failed creating zip entry: %v", err)
+		}
+		if _, err := io.WriteString(f, data); err != nil {
+			t.Fatalf("failed writing zip data: %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("failed closing zip: %v", err)
+	}
+	return b.Bytes()
+}
+
+func TestUnpackLimits(t *testing.T) {
+	host := serveFiles(t, map[string][]byte{
+		"/bomb.zip": makeZip(t, map[string]string{"a.bin": strings.Repeat("\x00", 10*1024*1024), "b.txt": "b", "c.txt": "c"}),
+		"/many.zip": makeZip(t, map[string]string{"a": "a", "b": "b", "c": "c", "d": "d"}),
+	})
+
+	for _, tc := range []struct {
+		name    string
+		maxSize uint64
+		opts    UnpackOptions
+	}{
+		{"/bomb.zip", 0, DefaultUnpackOptions},
+		{"/bomb.zip", 1024 * 1024, UnpackOptions{}},
+		{"/bomb.zip", 0, UnpackOptions{MaxSize: 1024 * 1024}},
+		{"/bomb.zip", 2 * 1024 * 1024, UnpackOptions{MaxSize: 100 * 1024 * 1024}},
+		{"/many.zip", 0, UnpackOptions{MaxEntries: 3}},
+	} {
+		a, err := NewARL("[http,"+host+tc.name+"]", tc.maxSize, 3)
+		if err != nil {
+			t.Fatalf("failed creating http ARL: %v", err)
+		}
+		a.SetUnpackOptions(tc.opts)
+		ch, err := a.Fetch()
+		if err != nil {
+			t.Fatalf("failed fetching http ARL: %v", err)
+		}
+		// The archive as a whole is reported as failed, the file being
+		// read when the limit was exceeded gets no data.
+		isErrorSeen := false
+		for c := range ch {
+			if errors.Is(c.Error, ErrorArchiveLimitExceeded) && c.FilePath == "" {
+				isErrorSeen = true
+			}
+			if c.Error != nil && c.Data != nil {
+				t.Errorf("%s: partial data for %s", tc.name, c.FilePath)
+			}
+		}
+		if !isErrorSeen {
+			t.Errorf("%s: unpack limits %+v exceeded but no error was produced", tc.name, tc.opts)
+		}
+	}
+
+	contents := fetchAll(t, "[http,"+host+"/many.zip]")
+	if len(contents) != 4 {
+		t.Errorf("unexpected contents: %v", contents)
+	}
+
+	// The decompressed size is limited by default, only explicitly
+	// unset limits let the bomb through.
+	if DefaultUnpackOptions.MaxSize == 0 {
+		t.Error("no default limit on the unpacked size")
+	}
+	a, err := New("[http,"+host+"/bomb.zip]", WithUnpackOptions(UnpackOptions{}))
+	if err != nil {
+		t.Fatalf("failed creating http ARL: %v", err)
+	}
+	for c, err := range a.All(context.Background()) {
+		if err != nil || c.Error != nil {
+			t.Errorf("unexpected error without limits: %v, %v", err, c.Error)
+		}
+	}
+}
+
+func TestUnsafeArchivePaths(t *testing.T) {
+	files := map[string]string{
+		"../../etc/cron.d/x": "evil",
+		"/etc/passwd":        "evil",
+		"C:\\Windows\\x":     "evil",
+		"ok/../fine":         "fine",
+		"dir\\good":          "good",
+	}
+	host := serveFiles(t, map[string][]byte{
+		"/evil.tar": makeTar(t, files),
+		"/evil.zip": makeZip(t, files),
+	})
+
+	for _, name := range []string{"/evil.tar", "/evil.zip"} {
+		contents := fetchAll(t, "[http,"+host+name+"]")
+		if len(contents) != 2 || contents["fine"] != "fine" || contents["dir/good"] != "good" {
+			t.Errorf("%s: unexpected contents: %v", name, contents)
+		}
+
+		a, err := NewARL("[http,"+host+name+"]", 1024*1024, 3)
+		if err != nil {
+			t.Fatalf("failed creating http ARL: %v", err)
+		}
+		opts := DefaultUnpackOptions
+		opts.RejectUnsafePaths = true
+		a.SetUnpackOptions(opts)
+		ch, err := a.Fetch()
+		if err != nil {
+			t.Fatalf("failed fetching http ARL: %v", err)
+		}
+		isErrorSeen := false
+		for c := range ch {
+			if errors.Is(c.Error, ErrorUnsafePath) {
+				isErrorSeen = true
+			} else if c.Data != nil && string(c.Data) == "evil" {
+				t.Errorf("%s: unsafe entry produced: %s", name, c.FilePath)
+			}
+		}
+		if !isErrorSeen {
+			t.Errorf("%s: unsafe path but no error was produced", name)
+		}
+	}
+}
+
+func TestEncryptedZip(t *testing.T) {
+	served := map[string][]byte{}
+	for _, name := range []string{"zipcrypto.zip", "streamed.zip", "aes128.zip", "aes256.zip"} {
+		data, err := os.ReadFile(filepath.Join("testdata", name))
+		if err != nil {
+			t.Fatalf("failed reading test archive: %v", err)
+		}
+		served["/"+name] = data
+	}
+	host := serveFiles(t, served)
+
+	fetch := func(name string, password string) ([]Content, error) {
+		a, err := NewARL("[http,"+host+"/"+name+"]", 1024*1024, 3)
+		if err != nil {
+			t.Fatalf("failed creating http ARL: %v", err)
+		}
+		opts := DefaultUnpackOptions
+		opts.Password = password
+		a.SetUnpackOptions(opts)
+		ch, err := a.Fetch()
+		if err != nil {
+			t.Fatalf("failed fetching http ARL: %v", err)
+		}
+		contents := []Content{}
+		for c := range ch {
+			if c.Error != nil {
+				err = c.Error
+			}
+			contents = append(contents, c)
+		}
+		return contents, err
+	}
+
+	for name, nFiles := range map[string]int{"zipcrypto.zip": 2, "streamed.zip": 1, "aes128.zip": 2, "aes256.zip": 2} {
+		contents, err := fetch(name, "infected")
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", name, err)
+		}
+		if len(contents) != nFiles {
+			t.Errorf("%s: unexpected number of files: %d", name, len(contents))
+		}
+		for _, c := range contents {
+			if !strings.HasPrefix(string(c.Data), "not actually malware") && !strings.HasPrefix(string(c.Data), "sample padding") {
+				t.Errorf("%s: unexpected data for %s: %q", name, c.FilePath, c.Data)
+			}
+		}
+
+		for _, password := range []string{"", "wrong"} {
+			if _, err := fetch(name, password); !errors.Is(err, ErrorInvalidPassword) {
+				t.Errorf("%s: password %q failed to produce error: %v", name, password, err)
+			}
+		}
+	}
+}
+
+func TestNestedArchives(t *testing.T) {
+	innerTarGz := bytes.Buffer{}
+	gzWriter := gzip.NewWriter(&innerTarGz)
+	gzWriter.Write(makeTar(t, map[string]string{"file.yaml": "yaml"}))
+	gzWriter.Close()
+	middle := makeZip(t, map[string]string{"inner.tar.gz": innerTarGz.String(), "plain.txt": "plain"})
+	outer := makeZip(t, map[string]string{"middle.zip": string(middle)})
+	host := serveFiles(t, map[string][]byte{"/outer.zip": outer})
+
+	for depth, expected := range []map[string]string{
+		{"middle.zip": string(middle)},
+		{"middle.zip/inner.tar.gz": innerTarGz.String(), "middle.zip/plain.txt": "plain"},
+		{"middle.zip/inner.tar.gz/file.yaml": "yaml", "middle.zip/plain.txt": "plain"},
+	} {
+		a, err := NewARL("[http,"+host+"/outer.zip]", 1024*1024, 3)
+		if err != nil {
+			t.Fatalf("failed creating http ARL: %v", err)
+		}
+		opts := DefaultUnpackOptions
+		opts.MaxDepth = depth
+		a.SetUnpackOptions(opts)
+		ch, err := a.Fetch()
+		if err != nil {
+			t.Fatalf("failed fetching http ARL: %v", err)
+		}
+		contents := map[string]string{}
+		for c := range ch {
+			if c.Error != nil {
+				t.Errorf("depth %d: unexpected error: %v", depth, c.Error)
+			}
+			contents[c.FilePath] = string(c.Data)
+		}
+		if len(contents) != len(expected) {
+			t.Errorf("depth %d: unexpected contents: %v", depth, contents)
+		}
+		for name, data := range expected {
+			if contents[name] != data {
+				t.Errorf("depth %d: unexpected data for %s: %q", depth, name, contents[name])
+			}
+		}
+	}
+}
+
+func TestUnpackMode(t *testing.T) {
+	zipData := makeZip(t, map[string]string{"a.yaml": "aaa"})
+	host := serveFiles(t, map[string][]byte{"/rules.zip": zipData})
+	RegisterMethod("multi", staticMethod{"rules.zip": string(zipData), "b.txt": "bbb"})
+
+	fetch := func(arl string, mode UnpackMode) map[string]string {
+		a, err := NewARL(arl, 1024*1024, 3)
+		if err != nil {
+			t.Fatalf("failed creating ARL: %v", err)
+		}
+		opts := DefaultUnpackOptions
+		opts.Mode = mode
+		a.SetUnpackOptions(opts)
+		ch, err := a.Fetch()
+		if err != nil {
+			t.Fatalf("failed fetching ARL: %v", err)
+		}
+		contents := map[string]string{}
+		for c := range ch {
+			if c.Error != nil {
+				t.Errorf("unexpected error: %v", c.Error)
+			}
+			contents[c.FilePath] = string(c.Data)
+		}
+		return contents
+	}
+
+	contents := fetch("[http,"+host+"/rules.zip]", UnpackNever)
+	if len(contents) != 1 || contents["rules.zip"] != string(zipData) {
+		t.Errorf("unexpected raw contents: %v", contents)
+	}
+
+	contents = fetch("[multi,root]", UnpackSingle)
+	if len(contents) != 2 || contents["rules.zip"] != string(zipData) {
+		t.Errorf("unexpected multi-file contents: %v", contents)
+	}
+
+	contents = fetch("[multi,root]", UnpackAlways)
+	if len(contents) != 2 || contents["rules.zip/a.yaml"] != "aaa" || contents["b.txt"] != "bbb" {
+		t.Errorf("unexpected forced contents: %v", contents)
+	}
+}
+
 func TestGCS(t *testing.T) {
 
 }
 
+// serveGCS serves the objects of a bucket the way GCS does, for a client
+// pointed at it with STORAGE_EMULATOR_HOST.
+func serveGCS(t *testing.T, bucket string, objects map[string]string) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/storage/v1/b/"+bucket+"/o" {
+			items := []string{}
+			for name, data := range objects {
+				if strings.HasPrefix(name, r.URL.Query().Get("prefix")) {
+					items = append(items, fmt.Sprintf(`{"name":%q,"bucket":%q,"size":"%d","generation":"1"}`, name, bucket, len(data)))
+				}
+			}
+			fmt.Fprintf(w, `{"kind":"storage#objects","items":[%s]}`, strings.Join(items, ","))
+			return
+		}
+		data, ok := objects[strings.TrimPrefix(r.URL.Path, "/"+bucket+"/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Header().Set("X-Goog-Generation", "1")
+		io.WriteString(w, data)
+	}))
+	t.Cleanup(srv.Close)
+	t.Setenv("STORAGE_EMULATOR_HOST", srv.URL)
+	return srv
+}
+
+func TestGCSLocal(t *testing.T) {
+	serveGCS(t, "bucket", map[string]string{
+		"rules/":           "",
+		"rules/a.yaml":     "aaa",
+		"rules/dir/":       "",
+		"rules/dir/b.yaml": "bbb",
+		"other/c.yaml":     "ccc",
+	})
+	auth := base64.StdEncoding.EncodeToString([]byte("{}"))
+
+	a, err := New("[gcs,bucket/rules,gaia," + auth + "]")
+	if err != nil {
+		t.Fatalf("failed creating gcs ARL: %v", err)
+	}
+	contents := map[string]string{}
+	for c, err := range a.All(context.Background()) {
+		if err != nil || c.Error != nil {
+			t.Fatalf("unexpected error fetching gcs ARL: %v, %v", err, c.Error)
+		}
+		if c.SourceURI != "gcs://bucket/rules/"+c.FilePath {
+			t.Errorf("unexpected source of %s: %s", c.FilePath, c.SourceURI)
+		}
+		contents[c.FilePath] = string(c.Data)
+	}
+	if len(contents) != 2 || contents["a.yaml"] != "aaa" || contents["dir/b.yaml"] != "bbb" {
+		t.Errorf("unexpected contents: %v", contents)
+	}
+
+	a, err = New("[gcs,bucket/rules/dir/b.yaml,gaia," + auth + "]")
+	if err != nil {
+		t.Fatalf("failed creating gcs ARL: %v", err)
+	}
+	entries, err := a.List(context.Background())
+	if err != nil || len(entries) != 1 || entries[0].FilePath != "b.yaml" {
+		t.Errorf("unexpected entries: %+v, %v", entries, err)
+	}
+}
+
 func TestHTTP(t *testing.T) {
 	a, err := NewARL("[https,app.limacharlie.io/get/windows/64]", 1024*1024*10, 3)
 	if err != nil {
@@ -72,6 +902,686 @@ func TestHTTP(t *testing.T) {
 	}
 }
 
+func TestHTTPContextCancel(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Never answer, only the client giving up ends the request.
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+
+	a, err := NewARL("[http,"+strings.TrimPrefix(srv.URL, "http://")+"/slow]", 1024, 3)
+	if err != nil {
+		t.Fatalf("failed creating http ARL: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err = a.FetchContext(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline exceeded, got: %v", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("cancelled fetch took too long: %v", time.Since(start))
+	}
+}
+
+func TestHTTPStream(t *testing.T) {
+	payload := strings.Repeat("limacharlie", 1000)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(payload)))
+		io.WriteString(w, payload)
+	}))
+	defer srv.Close()
+
+	a, err := NewARL("[http,"+strings.TrimPrefix(srv.URL, "http://")+"/data]", 1024*1024, 3)
+	if err != nil {
+		t.Fatalf("failed creating http ARL: %v", err)
+	}
+	ch, err := a.FetchStream(context.Background())
+	if err != nil {
+		t.Fatalf("failed streaming http ARL: %v", err)
+	}
+
+	nContents := 0
+	for c := range ch {
+		nContents++
+		if c.Error != nil {
+			t.Errorf("unexpected error streaming http ARL: %v", c.Error)
+			continue
+		}
+		if c.Size != int64(len(payload)) {
+			t.Errorf("unexpected size: %d", c.Size)
+		}
+		data, err := io.ReadAll(c.Reader)
+		c.Reader.Close()
+		if err != nil {
+			t.Errorf("failed reading stream: %v", err)
+		}
+		if string(data) != payload {
+			t.Errorf("unexpected data streamed: %d bytes", len(data))
+		}
+	}
+	if nContents != 1 {
+		t.Errorf("unexpected number of files streamed: %d", nContents)
+	}
+}
+
+func TestStreamUnpack(t *testing.T) {
+	// The server only sends the second entry once the first one has been
+	// received, so the archive must be unpacked as it is streamed.
+	firstReceived := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gzWriter := gzip.NewWriter(w)
+		tarWriter := tar.NewWriter(gzWriter)
+		for i, name := range []string{"first.yaml", "second.yaml"} {
+			if i == 1 {
+				select {
+				case <-firstReceived:
+				case <-r.Context().Done():
+					return
+				}
+			}
+			tarWriter.WriteHeader(&tar.Header{
+				Name:     name,
+				Mode:     0644,
+				Size:     int64(len(name)),
+				Typeflag: tar.TypeReg,
+			})
+			io.WriteString(tarWriter, name)
+			tarWriter.Flush()
+			gzWriter.Flush()
+			w.(http.Flusher).Flush()
+		}
+		tarWriter.Close()
+		gzWriter.Close()
+	}))
+	defer srv.Close()
+
+	a, err := NewARL("[http,"+strings.TrimPrefix(srv.URL, "http://")+"/rules.tar.gz]", 1024*1024, 3)
+	if err != nil {
+		t.Fatalf("failed creating http ARL: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	ch, err := a.FetchStream(ctx)
+	if err != nil {
+		t.Fatalf("failed streaming http ARL: %v", err)
+	}
+
+	names := []string{}
+	for c := range ch {
+		if c.Error != nil {
+			t.Fatalf("unexpected error streaming archive: %v", c.Error)
+		}
+		if len(names) == 0 {
+			close(firstReceived)
+		}
+		data, err := io.ReadAll(c.Reader)
+		c.Reader.Close()
+		if err != nil {
+			t.Errorf("failed reading entry: %v", err)
+		}
+		if c.Size != int64(len(data)) || string(data) != c.FilePath {
+			t.Errorf("unexpected entry %s (%d bytes): %q", c.FilePath, c.Size, data)
+		}
+		names = append(names, c.FilePath)
+	}
+	if len(names) != 2 || names[0] != "first.yaml" || names[1] != "second.yaml" {
+		t.Errorf("unexpected entries streamed: %v", names)
+	}
+}
+
+// slowFirstMethod produces numbered files, the first one being slow to
+// read.
+type slowFirstMethod int
+
+func (m slowFirstMethod) AuthTypes() []string {
+	return []string{""}
+}
+
+func (m slowFirstMethod) Fetch(ctx context.Context, a AuthenticatedResourceLocator) (chan StreamContent, error) {
+	chOut := make(chan StreamContent, m)
+	for i := 0; i < int(m); i++ {
+		var r io.Reader = strings.NewReader(strconv.Itoa(i))
+		if i == 0 {
+			r = io.MultiReader(readerFunc(func(p []byte) (int, error) {
+				time.Sleep(100 * time.Millisecond)
+				return 0, io.EOF
+			}), r)
+		}
+		chOut <- StreamContent{FilePath: strconv.Itoa(i), Reader: io.NopCloser(r)}
+	}
+	close(chOut)
+	return chOut, nil
+}
+
+type readerFunc func(p []byte) (int, error)
+
+func (f readerFunc) Read(p []byte) (int, error) {
+	return f(p)
+}
+
+func TestFetchOrder(t *testing.T) {
+	RegisterMethod("slowfirst", slowFirstMethod(5))
+	a, err := NewARL("[slowfirst,root]", 0, 4)
+	if err != nil {
+		t.Fatalf("failed creating ARL: %v", err)
+	}
+	ch, err := a.Fetch()
+	if err != nil {
+		t.Fatalf("failed fetching ARL: %v", err)
+	}
+	fetched := []string{}
+	for c := range ch {
+		if c.Error != nil || string(c.Data) != c.FilePath {
+			t.Errorf("unexpected content %s: %q, %v", c.FilePath, c.Data, c.Error)
+		}
+		fetched = append(fetched, c.FilePath)
+	}
+	if !slices.Equal(fetched, []string{"0", "1", "2", "3", "4"}) {
+		t.Errorf("files not fetched in order: %v", fetched)
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	modTime := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	tarData := bytes.Buffer{}
+	tarWriter := tar.NewWriter(&tarData)
+	tarWriter.WriteHeader(&tar.Header{
+		Name:     "run.sh",
+		Mode:     0755,
+		Size:     4,
+		ModTime:  modTime,
+		Typeflag: tar.TypeReg,
+	})
+	io.WriteString(tarWriter, "exit")
+	tarWriter.Close()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Last-Modified", modTime.Format(http.TimeFormat))
+		w.Header().Set("Content-Type", "text/plain")
+		if r.URL.Path == "/run.tar" {
+			w.Write(tarData.Bytes())
+			return
+		}
+		io.WriteString(w, "data")
+	}))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	for path, expected := range map[string]Metadata{
+		"/data": {
+			Size:        4,
+			ModTime:     modTime,
+			Version:     `"v1"`,
+			ContentType: "text/plain",
+		},
+		"/run.tar": {
+			Size:    4,
+			Mode:    0755,
+			ModTime: modTime,
+		},
+	} {
+		a, err := NewARL("[http,"+host+path+"]", 1024*1024, 3)
+		if err != nil {
+			t.Fatalf("failed creating http ARL: %v", err)
+		}
+		ch, err := a.Fetch()
+		if err != nil {
+			t.Fatalf("failed fetching http ARL: %v", err)
+		}
+		for c := range ch {
+			if c.Error != nil {
+				t.Errorf("unexpected error fetching %s: %v", path, c.Error)
+				continue
+			}
+			if c.Size != expected.Size || c.Mode != expected.Mode || !c.ModTime.Equal(expected.ModTime) || c.Version != expected.Version || c.ContentType != expected.ContentType {
+				t.Errorf("%s: unexpected metadata: %+v", path, c.Metadata)
+			}
+		}
+	}
+}
+
+// endlessMethod produces files until the fetch is stopped.
+type endlessMethod struct{}
+
+func (m endlessMethod) AuthTypes() []string {
+	return []string{""}
+}
+
+func (m endlessMethod) Fetch(ctx context.Context, a AuthenticatedResourceLocator) (chan StreamContent, error) {
+	chOut := make(chan StreamContent)
+	go func() {
+		defer finishStream(ctx, chOut)
+		for i := 0; ; i++ {
+			if !sendStream(ctx, chOut, StreamContent{
+				FilePath: strconv.Itoa(i),
+				Reader:   io.NopCloser(strings.NewReader("data")),
+			}) {
+				return
+			}
+		}
+	}()
+	return chOut, nil
+}
+
+func TestFetchHandleClose(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+	RegisterMethod("endless", endlessMethod{})
+	a, err := New("[endless,root]")
+	if err != nil {
+		t.Fatalf("failed creating endless ARL: %v", err)
+	}
+	h, err := a.Start(context.Background())
+	if err != nil {
+		t.Fatalf("failed starting endless ARL: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if c := <-h.Contents(); c.Error != nil {
+			t.Errorf("unexpected error: %v", c.Error)
+		}
+	}
+	h.Close()
+
+	// An archive streamed over HTTP, abandoned in the middle.
+	files := map[string]string{}
+	for i := 0; i < 100; i++ {
+		files[fmt.Sprintf("file%d", i)] = strings.Repeat("x", 64*1024)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(makeTar(t, files))
+	}))
+	defer srv.Close()
+	transport := &http.Transport{}
+	defer transport.CloseIdleConnections()
+
+	a, err = New("[http,"+strings.TrimPrefix(srv.URL, "http://")+"/rules.tar]", WithHTTPClient(&http.Client{Transport: transport}))
+	if err != nil {
+		t.Fatalf("failed creating http ARL: %v", err)
+	}
+	h, err = a.Start(context.Background())
+	if err != nil {
+		t.Fatalf("failed starting http ARL: %v", err)
+	}
+	if c := <-h.Contents(); c.Error != nil {
+		t.Errorf("unexpected error: %v", c.Error)
+	}
+	h.Close()
+}
+
+func TestFetchHandleCloseBackends(t *testing.T) {
+	srv := serveGitHub(t)
+	serveGCS(t, "bucket", map[string]string{"a": "a", "b": "b", "c": "c", "d": "d"})
+	transport := &http.Transport{}
+	defer transport.CloseIdleConnections()
+	auth := base64.StdEncoding.EncodeToString([]byte("{}"))
+
+	for _, arl := range []string{"[github,org/repo,token,abc]", "[gcs,bucket,gaia," + auth + "]"} {
+		ignored := goleak.IgnoreCurrent()
+		a, err := New(arl, WithHTTPClient(&http.Client{Transport: transport}), WithGitHubURLs(srv.URL, srv.URL), WithMaxConcurrent(2))
+		if err != nil {
+			t.Fatalf("failed creating %s: %v", arl, err)
+		}
+		h, err := a.Start(context.Background())
+		if err != nil {
+			t.Fatalf("failed starting %s: %v", arl, err)
+		}
+		if c := <-h.Contents(); c.Error != nil {
+			t.Errorf("%s: unexpected error: %v", arl, c.Error)
+		}
+		h.Close()
+		transport.CloseIdleConnections()
+		// The storage client keeps its idle connections in a transport
+		// of its own, they are not producers of the fetch.
+		goleak.VerifyNone(t, ignored,
+			goleak.IgnoreAnyFunction("net/http.(*persistConn).readLoop"),
+			goleak.IgnoreAnyFunction("net/http.(*persistConn).writeLoop"),
+			goleak.IgnoreAnyFunction("net/http.(*conn).serve"),
+		)
+	}
+}
+
+func TestMaxFilesStopsProducers(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+	RegisterMethod("endless", endlessMethod{})
+	a, err := New("[endless,root]", WithMaxFiles(2))
+	if err != nil {
+		t.Fatalf("failed creating endless ARL: %v", err)
+	}
+	ch, err := a.Fetch()
+	if err != nil {
+		t.Fatalf("failed fetching endless ARL: %v", err)
+	}
+	done := make(chan struct{})
+	nFiles := 0
+	var lastErr error
+	go func() {
+		defer close(done)
+		for c := range ch {
+			if c.Error != nil {
+				lastErr = c.Error
+				continue
+			}
+			nFiles++
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("fetch not stopped at the file limit")
+	}
+	if nFiles != 2 || !errors.Is(lastErr, ErrorMaxFilesExceeded) {
+		t.Errorf("unexpected fetch: %d files, %v", nFiles, lastErr)
+	}
+}
+
+func TestAll(t *testing.T) {
+	RegisterMethod("endless", endlessMethod{})
+	a, err := New("[endless,root]")
+	if err != nil {
+		t.Fatalf("failed creating endless ARL: %v", err)
+	}
+	// Breaking out of the loop stops the producers.
+	ignored := goleak.IgnoreCurrent()
+	nFiles := 0
+	for c, err := range a.All(context.Background()) {
+		if err != nil || c.Error != nil {
+			t.Fatalf("unexpected error: %v, %v", err, c.Error)
+		}
+		nFiles++
+		if nFiles == 3 {
+			break
+		}
+	}
+	goleak.VerifyNone(t, ignored)
+
+	zipData, err := os.ReadFile(filepath.Join("testdata", "zipcrypto.zip"))
+	if err != nil {
+		t.Fatalf("failed reading test archive: %v", err)
+	}
+	host := serveFiles(t, map[string][]byte{
+		"/samples.zip": zipData,
+		"/rules.tar":   makeTar(t, map[string]string{"a": "a", "b": "b", "c": "c"}),
+		"/bomb.zip":    makeZip(t, map[string]string{"a.bin": strings.Repeat("\x00", 10*1024*1024), "b.txt": "b", "c.txt": "c"}),
+		"/outer.zip":   makeZip(t, map[string]string{"inner.tar": string(makeTar(t, map[string]string{"../evil": "evil"}))}),
+	})
+
+	// Files which cannot be decrypted are not fatal.
+	a, err = New("[http," + host + "/samples.zip]")
+	if err != nil {
+		t.Fatalf("failed creating http ARL: %v", err)
+	}
+	nFileErrors := 0
+	for c, err := range a.All(context.Background()) {
+		if err != nil {
+			t.Fatalf("unexpected fatal error: %v", err)
+		}
+		if errors.Is(c.Error, ErrorInvalidPassword) {
+			nFileErrors++
+		}
+	}
+	if nFileErrors != 2 {
+		t.Errorf("unexpected number of file errors: %d", nFileErrors)
+	}
+
+	a, err = New("[http,"+host+"/rules.tar]", WithMaxFiles(1))
+	if err != nil {
+		t.Fatalf("failed creating http ARL: %v", err)
+	}
+	nFiles = 0
+	var fatal error
+	for c, err := range a.All(context.Background()) {
+		if err != nil {
+			fatal = err
+			continue
+		}
+		if c.Error == nil {
+			nFiles++
+		}
+	}
+	if nFiles != 1 || !errors.Is(fatal, ErrorMaxFilesExceeded) {
+		t.Errorf("unexpected fetch: %d files, %v", nFiles, fatal)
+	}
+
+	// Archive limits and rejected paths abort the fetch, even in nested
+	// archives.
+	opts := DefaultUnpackOptions
+	opts.RejectUnsafePaths = true
+	opts.MaxDepth = 1
+	for name, expected := range map[string]error{
+		"/bomb.zip":  ErrorArchiveLimitExceeded,
+		"/outer.zip": ErrorUnsafePath,
+	} {
+		a, err = New("[http,"+host+name+"]", WithUnpackOptions(opts))
+		if err != nil {
+			t.Fatalf("failed creating http ARL: %v", err)
+		}
+		fatal = nil
+		for c, err := range a.All(context.Background()) {
+			if err != nil {
+				fatal = err
+			} else if c.Error != nil {
+				t.Errorf("%s: unexpected file error: %v", name, c.Error)
+			}
+		}
+		if !errors.Is(fatal, expected) {
+			t.Errorf("%s: unexpected fatal error: %v", name, fatal)
+		}
+	}
+
+	a, err = New("[http," + host + "/missing]")
+	if err != nil {
+		t.Fatalf("failed creating http ARL: %v", err)
+	}
+	for _, err := range a.All(context.Background()) {
+		if !errors.Is(err, ErrorResourceNotFound) {
+			t.Errorf("missing resource failed to produce error: %v", err)
+		}
+	}
+}
+
+func TestFetchToDir(t *testing.T) {
+	tarData := bytes.Buffer{}
+	tarWriter := tar.NewWriter(&tarData)
+	modTime := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	for name, mode := range map[string]int64{"run.sh": 0755, "dir/a.yaml": 0600} {
+		tarWriter.WriteHeader(&tar.Header{
+			Name:     name,
+			Mode:     mode,
+			Size:     int64(len(name)),
+			ModTime:  modTime,
+			Typeflag: tar.TypeReg,
+		})
+		io.WriteString(tarWriter, name)
+	}
+	tarWriter.Close()
+	host := serveFiles(t, map[string][]byte{"/rules.tar": tarData.Bytes()})
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "stale.txt"), []byte("old"), 0644); err != nil {
+		t.Fatalf("failed writing stale file: %v", err)
+	}
+	a, err := New("[http," + host + "/rules.tar]")
+	if err != nil {
+		t.Fatalf("failed creating http ARL: %v", err)
+	}
+	if err := a.FetchToDir(context.Background(), dir, FetchToDirOptions{Delete: true}); err != nil {
+		t.Fatalf("failed fetching to dir: %v", err)
+	}
+
+	for name, mode := range map[string]os.FileMode{"run.sh": 0755, "dir/a.yaml": 0600} {
+		info, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			t.Errorf("%s: not written: %v", name, err)
+			continue
+		}
+		if info.Mode().Perm() != mode || !info.ModTime().Equal(modTime) {
+			t.Errorf("%s: unexpected mode %v or time %v", name, info.Mode(), info.ModTime())
+		}
+		if data, _ := os.ReadFile(filepath.Join(dir, name)); string(data) != name {
+			t.Errorf("%s: unexpected data %q", name, data)
+		}
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 2 {
+		t.Errorf("unexpected files left in dir: %v", entries)
+	}
+
+	// A fetch selecting no file leaves the directory alone.
+	os.WriteFile(filepath.Join(dir, "keep.txt"), []byte("keep"), 0644)
+	a, err = New("[http," + host + "/rules.tar,include=*.json]")
+	if err != nil {
+		t.Fatalf("failed creating http ARL: %v", err)
+	}
+	if err := a.FetchToDir(context.Background(), dir, FetchToDirOptions{Delete: true}); !errors.Is(err, ErrorResourceNotFound) {
+		t.Errorf("empty fetch failed to produce error: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "keep.txt")); err != nil {
+		t.Errorf("file deleted after an empty fetch: %v", err)
+	}
+
+	RegisterMethod("escape", staticMethod{"../../evil": "evil", "good": "good"})
+	a, err = New("[escape,root]")
+	if err != nil {
+		t.Fatalf("failed creating escape ARL: %v", err)
+	}
+	dir = filepath.Join(t.TempDir(), "a", "b")
+	if err := a.FetchToDir(context.Background(), dir, FetchToDirOptions{}); !errors.Is(err, ErrorUnsafePath) {
+		t.Errorf("escaping path failed to produce error: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "..", "..", "evil")); err == nil {
+		t.Error("file written outside of the directory")
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "good")); string(data) != "good" {
+		t.Errorf("unexpected data for good file: %q", data)
+	}
+}
+
+func TestFetchFS(t *testing.T) {
+	host := serveFiles(t, map[string][]byte{
+		"/rules.tar": makeTar(t, map[string]string{"a.yaml": "aaa", "dir/b.yaml": "bbb", "dir/sub/c.yaml": "ccc"}),
+	})
+	a, err := New("[http," + host + "/rules.tar]")
+	if err != nil {
+		t.Fatalf("failed creating http ARL: %v", err)
+	}
+	fsys, err := a.FetchFS(context.Background())
+	if err != nil {
+		t.Fatalf("failed fetching fs: %v", err)
+	}
+	if err := fstest.TestFS(fsys, "a.yaml", "dir/b.yaml", "dir/sub/c.yaml"); err != nil {
+		t.Errorf("invalid fs: %v", err)
+	}
+	info, err := fs.Stat(fsys, "dir/b.yaml")
+	if err != nil || info.Size() != 3 || info.Mode() != 0644 {
+		t.Errorf("unexpected file info: %v, %v", info, err)
+	}
+	entries, err := fs.ReadDir(fsys, "dir")
+	if err != nil || len(entries) != 2 || entries[0].Name() != "b.yaml" || !entries[1].IsDir() {
+		t.Errorf("unexpected dir entries: %v, %v", entries, err)
+	}
+
+	// The paths of a repo are the same as the ones of an archive.
+	srv := serveGitHub(t)
+	a, err = New("[github,org/repo,token,abc]", WithGitHubURLs(srv.URL, srv.URL))
+	if err != nil {
+		t.Fatalf("failed creating github ARL: %v", err)
+	}
+	fsys, err = a.FetchFS(context.Background())
+	if err != nil {
+		t.Fatalf("failed fetching fs: %v", err)
+	}
+	if data, err := fs.ReadFile(fsys, "dir/b.yaml"); err != nil || string(data) != "bbb" {
+		t.Errorf("unexpected file data: %q, %v", data, err)
+	}
+}
+
+func TestHTTPMaxSize(t *testing.T) {
+	payload := strings.Repeat("limacharlie", 1000)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/sized" {
+			w.Header().Set("Content-Length", strconv.Itoa(len(payload)))
+		}
+		io.WriteString(w, payload)
+		// Flush so that no Content-Length is computed for the response.
+		w.(http.Flusher).Flush()
+	}))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	// With a Content-Length, the fetch is refused up front.
+	a, err := NewARL("[http,"+host+"/sized]", 1024, 3)
+	if err != nil {
+		t.Fatalf("failed creating http ARL: %v", err)
+	}
+	if _, err := a.Fetch(); !errors.Is(err, ErrorMaxSizeExceeded) {
+		t.Errorf("expected max size error, got: %v", err)
+	}
+
+	// Without one, reading the body is cut short.
+	a, err = NewARL("[http,"+host+"/chunked]", 1024, 3)
+	if err != nil {
+		t.Fatalf("failed creating http ARL: %v", err)
+	}
+	ch, err := a.Fetch()
+	if err != nil {
+		t.Fatalf("failed fetching http ARL: %v", err)
+	}
+	isErrorSeen := false
+	for c := range ch {
+		if errors.Is(c.Error, ErrorMaxSizeExceeded) {
+			isErrorSeen = true
+		}
+	}
+	if !isErrorSeen {
+		t.Error("max size exceeded but no error was produced")
+	}
+}
+
+func TestHTTPErrors(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/missing":
+			w.WriteHeader(http.StatusNotFound)
+		case "/private":
+			w.WriteHeader(http.StatusUnauthorized)
+		case "/throttled":
+			w.Header().Set("X-RateLimit-Remaining", "0")
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	for path, expected := range map[string]error{
+		"/missing":   ErrorResourceNotFound,
+		"/private":   ErrorUnauthorized,
+		"/throttled": ErrorRateLimited,
+	} {
+		a, err := NewARL("[http,"+host+path+"?secret=s3cr3t]", 1024, 3)
+		if err != nil {
+			t.Fatalf("failed creating http ARL: %v", err)
+		}
+		_, err = a.Fetch()
+		if !errors.Is(err, expected) {
+			t.Errorf("%s: expected %v, got: %v", path, expected, err)
+		}
+		var statusErr *HTTPStatusError
+		if !errors.As(err, &statusErr) {
+			t.Errorf("%s: expected an HTTPStatusError, got: %T", path, err)
+			continue
+		}
+		if strings.Contains(statusErr.Error(), "s3cr3t") {
+			t.Errorf("%s: error not redacted: %v", path, statusErr)
+		}
+	}
+}
+
 func TestHTTPS(t *testing.T) {
 	a, err := NewARL("https://app.limacharlie.io/get/windows/64", 1024*1024*10, 3)
 	if err != nil {
@@ -100,6 +1610,116 @@ func TestHTTPS(t *testing.T) {
 	}
 }
 
+// countingTransport counts the requests going through it.
+type countingTransport struct {
+	requests atomic.Int64
+}
+
+func (c *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	c.requests.Add(1)
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// serveGitHub serves a fake GitHub API and codeload for the org/repo repo
+// containing a.yaml and dir/b.yaml.
+func serveGitHub(t *testing.T) *httptest.Server {
+	files := map[string]string{"a.yaml": "aaa", "dir/b.yaml": "bbb"}
+	tarGz := bytes.Buffer{}
+	gzWriter := gzip.NewWriter(&tarGz)
+	gzWriter.Write(makeTar(t, map[string]string{"repo-HEAD/a.yaml": "aaa", "repo-HEAD/dir/b.yaml": "bbb"}))
+	gzWriter.Close()
+
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/org/repo/tar.gz/HEAD" {
+			w.Write(tarGz.Bytes())
+			return
+		}
+		if r.Header.Get("Authorization") != "token abc" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fileEntry := func(name string) string {
+			return fmt.Sprintf(`{"type":"file","path":%q,"size":%d,"sha":"sha-%s","download_url":"%s/raw/%s"}`, name, len(files[name]), name, srv.URL, name)
+		}
+		switch r.URL.Path {
+		case "/repos/org/repo/contents/":
+			fmt.Fprintf(w, `[%s,{"type":"dir","path":"dir"}]`, fileEntry("a.yaml"))
+		case "/repos/org/repo/contents/dir":
+			fmt.Fprintf(w, `[%s]`, fileEntry("dir/b.yaml"))
+		default:
+			data, ok := files[strings.TrimPrefix(r.URL.Path, "/raw/")]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			io.WriteString(w, data)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestGithubLocal(t *testing.T) {
+	srv := serveGitHub(t)
+	transport := &countingTransport{}
+
+	for _, arl := range []string{"[github,org/repo,token,abc]", "[github,org/repo]"} {
+		a, err := New(arl, WithHTTPClient(&http.Client{Transport: transport}), WithGitHubURLs(srv.URL, srv.URL))
+		if err != nil {
+			t.Fatalf("failed creating github ARL: %v", err)
+		}
+		ch, err := a.Fetch()
+		if err != nil {
+			t.Fatalf("failed fetching %s: %v", arl, err)
+		}
+		contents := map[string]string{}
+		for c := range ch {
+			if c.Error != nil {
+				t.Errorf("unexpected error fetching %s: %v", arl, c.Error)
+				continue
+			}
+			contents[c.FilePath] = string(c.Data)
+		}
+		if len(contents) != 2 || contents["a.yaml"] != "aaa" || contents["dir/b.yaml"] != "bbb" {
+			t.Errorf("%s: unexpected contents: %v", arl, contents)
+		}
+	}
+	// Two listings and two downloads, then the tarball.
+	if n := transport.requests.Load(); n != 5 {
+		t.Errorf("unexpected number of requests through the client: %d", n)
+	}
+}
+
+func TestGithubLocalSubDir(t *testing.T) {
+	srv := serveGitHub(t)
+
+	for arl, source := range map[string]string{
+		"[github,org/repo/dir,token,abc]": srv.URL + "/raw/dir/b.yaml",
+		"[github,org/repo/dir]":           "https://github.com/org/repo/blob/HEAD/dir/b.yaml",
+	} {
+		a, err := New(arl, WithGitHubURLs(srv.URL, srv.URL))
+		if err != nil {
+			t.Fatalf("failed creating github ARL: %v", err)
+		}
+		ch, err := a.Fetch()
+		if err != nil {
+			t.Fatalf("failed fetching %s: %v", arl, err)
+		}
+		contents := []Content{}
+		for c := range ch {
+			if c.Error != nil {
+				t.Errorf("unexpected error fetching %s: %v", arl, c.Error)
+				continue
+			}
+			contents = append(contents, c)
+		}
+		if len(contents) != 1 || contents[0].FilePath != "b.yaml" || contents[0].SourceURI != source {
+			t.Errorf("%s: unexpected contents: %+v", arl, contents)
+		}
+	}
+}
+
 func TestGithub(t *testing.T) {
 	a, err := NewARL("[github,refractionPOINT/python-limacharlie?ref=master]", 1024*1024*10, 10)
 	if err != nil {
@@ -138,8 +1758,8 @@ func TestGithubSubDir(t *testing.T) {
 			if c.Error != nil {
 				t.Errorf("unexpected error fetching github arl: %v", c.Error)
 			}
-			if !strings.HasPrefix(c.FilePath, "limacharlie") {
-				t.Errorf("unexpected file outside of subdir: %s", c.FilePath)
+			if !strings.HasSuffix(c.SourceURI, "/limacharlie/"+c.FilePath) {
+				t.Errorf("unexpected file outside of subdir: %s (%s)", c.FilePath, c.SourceURI)
 			}
 			nContents += 1
 		}
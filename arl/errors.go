@@ -0,0 +1,109 @@
+// *************************************************************************
+//
+// REFRACTION POINT CONFIDENTIAL
+// __________________
+//
+//  Copyright 2018 Refraction Point Inc.
+//  All Rights Reserved.
+//
+// NOTICE:  All information contained herein is, and remains
+// the property of Refraction Point Inc. and its suppliers,
+// if any.  The intellectual and technical concepts contained
+// herein are proprietary to Refraction Point Inc
+// and its suppliers and may be covered by U.S. and Foreign Patents,
+// patents in process, and are protected by trade secret or copyright law.
+// Dissemination of this information or reproduction of this material
+// is strictly forbidden unless prior written permission is obtained
+// from Refraction Point Inc.
+//
+
+package arl
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// HTTPStatusError is returned when a server answers with an unexpected
+// status. It matches ErrorResourceNotFound, ErrorUnauthorized or
+// ErrorRateLimited with errors.Is when the status is one of those.
+type HTTPStatusError struct {
+	StatusCode int
+	Status     string
+	// URL is the requested URL without its credentials or query.
+	URL string
+
+	kind error
+}
+
+func newHTTPStatusError(resp *http.Response, reqURL string) *HTTPStatusError {
+	e := &HTTPStatusError{
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+		URL:        redactURL(reqURL),
+	}
+	switch resp.StatusCode {
+	case http.StatusNotFound, http.StatusGone:
+		e.kind = ErrorResourceNotFound
+	case http.StatusUnauthorized:
+		e.kind = ErrorUnauthorized
+	case http.StatusForbidden:
+		// GitHub signals an exhausted rate limit with a 403.
+		if resp.Header.Get("X-RateLimit-Remaining") == "0" {
+			e.kind = ErrorRateLimited
+		} else {
+			e.kind = ErrorUnauthorized
+		}
+	case http.StatusTooManyRequests:
+		e.kind = ErrorRateLimited
+	}
+	return e
+}
+
+func (e *HTTPStatusError) Error() string {
+	return fmt.Sprintf("failed to get %s: %s", e.URL, e.Status)
+}
+
+func (e *HTTPStatusError) Unwrap() error {
+	return e.kind
+}
+
+// redactURL strips what may hold secrets from a URL: the user info and
+// the query.
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		return "<invalid url>"
+	}
+	u.User = nil
+	u.RawQuery = ""
+	u.Fragment = ""
+	return u.String()
+}
+
+// kindError attaches one of the sentinel errors to an error coming from a
+// dependency, both match with errors.Is.
+type kindError struct {
+	kind error
+	err  error
+}
+
+// withKind returns err tagged with kind, or err as-is if kind is nil.
+func withKind(kind error, err error) error {
+	if kind == nil || err == nil {
+		return err
+	}
+	return &kindError{
+		kind: kind,
+		err:  err,
+	}
+}
+
+func (e *kindError) Error() string {
+	return e.err.Error()
+}
+
+func (e *kindError) Unwrap() []error {
+	return []error{e.kind, e.err}
+}
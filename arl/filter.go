@@ -0,0 +1,104 @@
+// *************************************************************************
+//
+// REFRACTION POINT CONFIDENTIAL
+// __________________
+//
+//  Copyright 2018 Refraction Point Inc.
+//  All Rights Reserved.
+//
+// NOTICE:  All information contained herein is, and remains
+// the property of Refraction Point Inc. and its suppliers,
+// if any.  The intellectual and technical concepts contained
+// herein are proprietary to Refraction Point Inc
+// and its suppliers and may be covered by U.S. and Foreign Patents,
+// patents in process, and are protected by trade secret or copyright law.
+// Dissemination of this information or reproduction of this material
+// is strictly forbidden unless prior written permission is obtained
+// from Refraction Point Inc.
+//
+
+package arl
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/bmatcuk/doublestar/v4"
+)
+
+// Filter selects the files to fetch by their FilePath, using glob patterns
+// where "**" matches any number of directories. A file is fetched if it
+// matches one of the Include patterns, or if there are none, and none of
+// the Exclude ones.
+type Filter struct {
+	Include []string
+	Exclude []string
+}
+
+// Validate returns an error wrapping path.ErrBadPattern if one of the
+// patterns is malformed.
+func (f Filter) Validate() error {
+	for _, p := range append(append([]string{}, f.Include...), f.Exclude...) {
+		if !doublestar.ValidatePattern(p) {
+			return fmt.Errorf("%w: %q", path.ErrBadPattern, p)
+		}
+	}
+	return nil
+}
+
+// Match reports whether the file at name, slash separated and without a
+// leading slash, is selected by the filter.
+func (f Filter) Match(name string) bool {
+	included := len(f.Include) == 0
+	for _, p := range f.Include {
+		if doublestar.MatchUnvalidated(p, name) {
+			included = true
+			break
+		}
+	}
+	if !included {
+		return false
+	}
+	for _, p := range f.Exclude {
+		if doublestar.MatchUnvalidated(p, name) {
+			return false
+		}
+	}
+	return true
+}
+
+// parseOptions parses the options component of an ARL string, made of
+// "key=value" pairs separated by "&". The include and exclude keys can be
+// repeated to give several patterns.
+func parseOptions(options string) (Filter, error) {
+	f := Filter{}
+	if options == "" {
+		return f, nil
+	}
+	for _, option := range strings.Split(options, "&") {
+		key, value, ok := strings.Cut(option, "=")
+		if !ok {
+			return f, fmt.Errorf("%w: option %q is not key=value", ErrorInvalidFormat, option)
+		}
+		switch strings.ToLower(strings.TrimSpace(key)) {
+		case "include":
+			f.Include = append(f.Include, value)
+		case "exclude":
+			f.Exclude = append(f.Exclude, value)
+		default:
+			return f, fmt.Errorf("%w: unknown option %q", ErrorInvalidFormat, key)
+		}
+	}
+	if err := f.Validate(); err != nil {
+		return f, fmt.Errorf("%w: %w", ErrorInvalidFormat, err)
+	}
+	return f, nil
+}
+
+// skipFile reports whether a backend should skip the file at filePath.
+// The resources about to be unpacked are kept, their files are filtered as
+// they are unpacked.
+func (a AuthenticatedResourceLocator) skipFile(filePath string, unpack bool) bool {
+	return !shouldUnpack(a.unpackOptions.Mode, unpack) && !a.filter.Match(filePath)
+}
@@ -0,0 +1,245 @@
+// *************************************************************************
+//
+// REFRACTION POINT CONFIDENTIAL
+// __________________
+//
+//  Copyright 2018 Refraction Point Inc.
+//  All Rights Reserved.
+//
+// NOTICE:  All information contained herein is, and remains
+// the property of Refraction Point Inc. and its suppliers,
+// if any.  The intellectual and technical concepts contained
+// herein are proprietary to Refraction Point Inc
+// and its suppliers and may be covered by U.S. and Foreign Patents,
+// patents in process, and are protected by trade secret or copyright law.
+// Dissemination of this information or reproduction of this material
+// is strictly forbidden unless prior written permission is obtained
+// from Refraction Point Inc.
+//
+
+package arl
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+// FS is a read-only file system holding the files of a completed fetch,
+// named by their FilePath. It implements fs.ReadDirFS, fs.ReadFileFS and
+// fs.StatFS, the Sys of the fs.FileInfo of its files being their Metadata.
+type FS struct {
+	files map[string]*Content
+	// dirs holds the entries of every directory, sorted by name.
+	dirs map[string][]fs.DirEntry
+}
+
+// FetchFS fetches the resources into memory and returns them as an FS.
+// Like FetchToDir, the files which could not be fetched are reported
+// together once the fetch is done, while the first error aborting the
+// whole fetch is returned right away.
+func (a *AuthenticatedResourceLocator) FetchFS(ctx context.Context) (*FS, error) {
+	contents := []Content{}
+	fileErrors := []error{}
+	for c, err := range a.All(ctx) {
+		if err != nil {
+			return nil, err
+		}
+		if c.Error != nil {
+			fileErrors = append(fileErrors, fmt.Errorf("%s: %w", c.FilePath, c.Error))
+			continue
+		}
+		contents = append(contents, c)
+	}
+	if len(fileErrors) != 0 {
+		return nil, errors.Join(fileErrors...)
+	}
+	return newFS(contents)
+}
+
+func newFS(contents []Content) (*FS, error) {
+	f := &FS{
+		files: map[string]*Content{},
+		dirs:  map[string][]fs.DirEntry{".": nil},
+	}
+	for i := range contents {
+		name, err := cleanEntryName(contents[i].FilePath)
+		if err != nil {
+			return nil, err
+		}
+		f.files[name] = &contents[i]
+	}
+	for name, c := range f.files {
+		f.addEntry(name, fileInfo{name: path.Base(name), content: c})
+	}
+	for name := range f.files {
+		if _, ok := f.dirs[name]; ok {
+			return nil, fmt.Errorf("%s is both a file and a directory", name)
+		}
+	}
+	for _, entries := range f.dirs {
+		slices.SortFunc(entries, func(a, b fs.DirEntry) int {
+			return strings.Compare(a.Name(), b.Name())
+		})
+	}
+	return f, nil
+}
+
+// addEntry adds an entry for name to its parent directory, creating the
+// parents as needed.
+func (f *FS) addEntry(name string, info fileInfo) {
+	dir := path.Dir(name)
+	if _, ok := f.dirs[dir]; !ok {
+		f.addEntry(dir, fileInfo{name: path.Base(dir), isDir: true})
+		f.dirs[dir] = nil
+	}
+	f.dirs[dir] = append(f.dirs[dir], fs.FileInfoToDirEntry(&info))
+}
+
+func (f *FS) stat(op string, name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	if c, ok := f.files[name]; ok {
+		return &fileInfo{name: path.Base(name), content: c}, nil
+	}
+	if _, ok := f.dirs[name]; ok {
+		return &fileInfo{name: path.Base(name), isDir: true}, nil
+	}
+	return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+}
+
+func (f *FS) Open(name string) (fs.File, error) {
+	info, err := f.stat("open", name)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return &openDir{info: info, entries: f.dirs[name]}, nil
+	}
+	return &openFile{info: info, Reader: bytes.NewReader(f.files[name].Data)}, nil
+}
+
+func (f *FS) Stat(name string) (fs.FileInfo, error) {
+	return f.stat("stat", name)
+}
+
+func (f *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	info, err := f.stat("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+	return slices.Clone(f.dirs[name]), nil
+}
+
+func (f *FS) ReadFile(name string) ([]byte, error) {
+	info, err := f.stat("readfile", name)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, &fs.PathError{Op: "readfile", Path: name, Err: errors.New("is a directory")}
+	}
+	return slices.Clone(f.files[name].Data), nil
+}
+
+// fileInfo describes a file of an FS, or a directory if content is nil.
+type fileInfo struct {
+	name    string
+	isDir   bool
+	content *Content
+}
+
+func (i *fileInfo) Name() string {
+	return i.name
+}
+
+func (i *fileInfo) Size() int64 {
+	if i.content == nil {
+		return 0
+	}
+	return int64(len(i.content.Data))
+}
+
+func (i *fileInfo) Mode() fs.FileMode {
+	if i.isDir {
+		return fs.ModeDir | 0555
+	}
+	if i.content != nil && i.content.Mode.Perm() != 0 {
+		return i.content.Mode.Perm()
+	}
+	return 0444
+}
+
+func (i *fileInfo) ModTime() time.Time {
+	if i.content == nil {
+		return time.Time{}
+	}
+	return i.content.ModTime
+}
+
+func (i *fileInfo) IsDir() bool {
+	return i.isDir
+}
+
+func (i *fileInfo) Sys() any {
+	if i.content == nil {
+		return nil
+	}
+	return i.content.Metadata
+}
+
+type openFile struct {
+	*bytes.Reader
+	info fs.FileInfo
+}
+
+func (f *openFile) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *openFile) Close() error {
+	return nil
+}
+
+type openDir struct {
+	info    fs.FileInfo
+	entries []fs.DirEntry
+	offset  int
+}
+
+func (d *openDir) Stat() (fs.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *openDir) Read(p []byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.Name(), Err: errors.New("is a directory")}
+}
+
+func (d *openDir) Close() error {
+	return nil
+}
+
+func (d *openDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	remaining := d.entries[d.offset:]
+	if n <= 0 {
+		d.offset = len(d.entries)
+		return slices.Clone(remaining), nil
+	}
+	if len(remaining) == 0 {
+		return nil, io.EOF
+	}
+	n = min(n, len(remaining))
+	d.offset += n
+	return slices.Clone(remaining[:n]), nil
+}
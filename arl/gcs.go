@@ -20,105 +20,214 @@
 package arl
 
 import (
-	"bytes"
 	"context"
 	"encoding/base64"
+	"errors"
 	"fmt"
-	"io"
+	"net/http"
+	"strconv"
 	"strings"
 	"sync"
 
 	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
 )
 
-func (a AuthenticatedResourceLocator) getGCS() (chan Content, error) {
+// listGCSObjects opens a client and lists the objects selected under the
+// ARL's destination, single being true when the destination is a single
+// object. The caller must close the client.
+func (a AuthenticatedResourceLocator) listGCSObjects(ctx context.Context) (client *storage.Client, bucket *storage.BucketHandle, blobs []*storage.ObjectAttrs, single bool, err error) {
 	authBlob, err := base64.StdEncoding.DecodeString(a.authData)
 	if err != nil {
-		return nil, err
+		return nil, nil, nil, false, err
 	}
-	ctx := context.Background()
-	client, err := storage.NewClient(ctx, option.WithCredentialsJSON([]byte(authBlob)))
+	client, err = storage.NewClient(ctx, option.WithCredentialsJSON([]byte(authBlob)))
 	if err != nil {
-		return nil, err
+		return nil, nil, nil, false, err
 	}
 
-	components := strings.Split(a.methodDest, "/")
-	bucketName := components[0]
-	bucketPath := ""
-	if len(components) == 1 {
-		bucketPath = ""
-	} else {
-		bucketPath = strings.Join(components[1:], "/")
-	}
+	bucketName, bucketPath := a.gcsDest()
 
-	bucket := client.Bucket(bucketName)
+	bucket = client.Bucket(bucketName)
 
 	it := bucket.Objects(ctx, &storage.Query{Prefix: bucketPath})
-	blobs := []*storage.ObjectAttrs{}
+	listed := []*storage.ObjectAttrs{}
 	for {
 		attrs, err := it.Next()
 		if err == iterator.Done {
 			break
 		}
-		blobs = append(blobs, attrs)
+		if err != nil {
+			client.Close()
+			return nil, nil, nil, false, withKind(gcsErrorKind(err), fmt.Errorf("failed to list bucket: %w", err))
+		}
+		listed = append(listed, attrs)
+	}
+	single = len(listed) == 1
+	for _, o := range listed {
+		// Folders are not files, like the placeholders the console
+		// creates for them.
+		if strings.HasSuffix(o.Name, "/") {
+			continue
+		}
+		if !a.skipFile(a.gcsFilePath(o), single) {
+			blobs = append(blobs, o)
+		}
+	}
+	if len(blobs) == 0 {
+		client.Close()
+		return nil, nil, nil, false, fmt.Errorf("%w: gcs://%s/%s", ErrorResourceNotFound, bucketName, bucketPath)
+	}
+	return client, bucket, blobs, single, nil
+}
+
+// gcsDest splits the destination into the bucket and the prefix of the
+// objects.
+func (a AuthenticatedResourceLocator) gcsDest() (bucketName string, bucketPath string) {
+	components := strings.Split(a.methodDest, "/")
+	bucketName = components[0]
+	if len(components) == 1 {
+		bucketPath = ""
+	} else {
+		bucketPath = strings.Join(components[1:], "/")
+	}
+	return bucketName, bucketPath
+}
+
+func (a AuthenticatedResourceLocator) gcsFilePath(o *storage.ObjectAttrs) string {
+	_, bucketPath := a.gcsDest()
+	return relativePath(o.Name, bucketPath)
+}
+
+func gcsSourceURI(o *storage.ObjectAttrs) string {
+	return fmt.Sprintf("gcs://%s/%s", o.Bucket, o.Name)
+}
+
+func gcsMetadata(o *storage.ObjectAttrs) Metadata {
+	return Metadata{
+		Size:        o.Size,
+		ModTime:     o.Updated,
+		Version:     strconv.FormatInt(o.Generation, 10),
+		ContentType: o.ContentType,
+		MD5:         o.MD5,
 	}
+}
+
+func (a AuthenticatedResourceLocator) listGCS(ctx context.Context) ([]Entry, error) {
+	client, _, blobs, single, err := a.listGCSObjects(ctx)
+	if err != nil {
+		return nil, err
+	}
+	client.Close()
+
+	entries := []Entry{}
+	for _, o := range blobs {
+		entries = append(entries, Entry{
+			FilePath:  a.gcsFilePath(o),
+			SourceURI: gcsSourceURI(o),
+			Metadata:  gcsMetadata(o),
+			Unpack:    single,
+		})
+	}
+	return entries, nil
+}
 
-	chOut := make(chan Content)
+func (a AuthenticatedResourceLocator) getGCS(ctx context.Context) (chan StreamContent, error) {
+	client, bucket, blobs, single, err := a.listGCSObjects(ctx)
+	if err != nil {
+		return nil, err
+	}
+	totalSize := uint64(0)
+	for _, o := range blobs {
+		totalSize += uint64(o.Size)
+	}
+	if err := checkSize(totalSize, a.maxSize); err != nil {
+		client.Close()
+		return nil, err
+	}
+	if err := checkFiles(uint64(len(blobs)), a.maxFiles); err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	chOut := make(chan StreamContent, a.maxConcurrent)
 	chIn := make(chan *storage.ObjectAttrs)
 	wg := sync.WaitGroup{}
+	// The readers handed out must stay usable until the consumer
+	// closes them, only then can the client be closed. Consumers close
+	// each reader before waiting for the end of the stream, so the
+	// client is released before the stream ends.
+	readers := sync.WaitGroup{}
 
 	for i := uint64(0); i < a.maxConcurrent; i++ {
 		go func() {
+			defer wg.Done()
 			for o := range chIn {
-				out := Content{
-					FilePath: fmt.Sprintf("gcs://%s/%s", bucketName, o.Name),
+				out := StreamContent{
+					FilePath:  a.gcsFilePath(o),
+					SourceURI: gcsSourceURI(o),
+					Metadata:  gcsMetadata(o),
+					// If there was only one blob, we check if
+					// it's an archive and multiplex it.
+					Unpack: single,
 				}
 				reader, err := bucket.Object(o.Name).NewReader(ctx)
 				if err != nil {
-					out.Error = err
-					chOut <- out
-					continue
-				}
-				b := bytes.Buffer{}
-				_, err = io.Copy(&b, reader)
-				if err != nil {
-					out.Error = err
-					out.Data = b.Bytes()
-					chOut <- out
-					continue
-				}
-				reader.Close()
-				out.Data = b.Bytes()
-
-				// If there was only one blob, we check if
-				// it's an archive and multiplex it.
-				if len(blobs) == 1 {
-					for b := range multiplexContent(out) {
-						chOut <- b
+					out.Error = withKind(gcsErrorKind(err), err)
+				} else {
+					readers.Add(1)
+					out.Reader = &onCloseReader{
+						ReadCloser: reader,
+						onClose:    readers.Done,
 					}
-					continue
 				}
-				chOut <- out
+				if !sendStream(ctx, chOut, out) {
+					return
+				}
 			}
-			wg.Done()
 		}()
 		wg.Add(1)
 	}
 
 	go func() {
+		defer close(chIn)
 		for _, b := range blobs {
-			chIn <- b
+			select {
+			case chIn <- b:
+			case <-ctx.Done():
+				return
+			}
 		}
-		close(chIn)
 	}()
 
 	go func() {
 		wg.Wait()
+		readers.Wait()
 		client.Close()
-		close(chOut)
+		finishStream(ctx, chOut)
 	}()
 
 	return chOut, nil
 }
+
+// gcsErrorKind maps the errors of the storage client to the matching
+// sentinel error, if any.
+func gcsErrorKind(err error) error {
+	if errors.Is(err, storage.ErrBucketNotExist) || errors.Is(err, storage.ErrObjectNotExist) {
+		return ErrorResourceNotFound
+	}
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		switch apiErr.Code {
+		case http.StatusNotFound:
+			return ErrorResourceNotFound
+		case http.StatusUnauthorized, http.StatusForbidden:
+			return ErrorUnauthorized
+		case http.StatusTooManyRequests:
+			return ErrorRateLimited
+		}
+	}
+	return nil
+}
@@ -36,35 +36,64 @@ import (
 	"github.com/go-git/go-git/v5"
 	"github.com/go-git/go-git/v5/plumbing"
 	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
 	"github.com/go-git/go-git/v5/plumbing/transport/ssh"
 	"github.com/go-git/go-git/v5/storage/memory"
 )
 
+// DefaultGitHubAPIURL and DefaultGitHubCodeloadURL are the base URLs of the
+// GitHub REST API and of the repo tarballs.
+const (
+	DefaultGitHubAPIURL      = "https://api.github.com"
+	DefaultGitHubCodeloadURL = "https://codeload.github.com"
+)
+
 type githubFileRecord struct {
 	Path        string
 	DownloadURL string
+	Size        int64
+	// SHA is the hash of the git blob.
+	SHA string
+}
+
+func (r githubFileRecord) metadata() Metadata {
+	return Metadata{
+		Size:    r.Size,
+		Version: r.SHA,
+	}
 }
 
-func (a AuthenticatedResourceLocator) getGitHub() (chan Content, error) {
+func (a AuthenticatedResourceLocator) getGitHub(ctx context.Context) (chan StreamContent, error) {
 	if a.authType == "" || a.authType == "ssh" {
 		// If there is no auth, we can use the git package.
-		return a.getGitHubFromGit()
+		return a.getGitHubFromGit(ctx)
 	}
 
 	// With a token, use the API.
-	return a.getGitHubFromAPI()
+	return a.getGitHubFromAPI(ctx)
 }
 
-func (a AuthenticatedResourceLocator) getGitHubFromGit() (chan Content, error) {
+func (a AuthenticatedResourceLocator) listGitHub(ctx context.Context) ([]Entry, error) {
+	if a.authType == "" {
+		// The tarball has to be streamed to be listed.
+		return nil, errors.ErrUnsupported
+	}
+	if a.authType == "ssh" {
+		return a.listGitHubFromGit(ctx)
+	}
+	return a.listGitHubFromAPI(ctx)
+}
+
+// parseGitDest splits the destination of a git fetch into the repo, the
+// path in the repo and the optional branch.
+func (a AuthenticatedResourceLocator) parseGitDest() (repoPath string, pathInRepo string, targetBranch string, err error) {
 	// If the path in repo ends with "?ref=...", we extract the
 	// ref name we want to look for.
-	targetBranch := ""
-	pathInRepo := ""
 	dest := a.methodDest
 	if strings.Contains(a.methodDest, "?ref=") {
 		components := strings.SplitN(a.methodDest, "?ref=", 2)
 		if len(components) != 2 {
-			return nil, errors.New("invalid github path")
+			return "", "", "", errors.New("invalid github path")
 		}
 		dest = components[0]
 		targetBranch = components[1]
@@ -73,19 +102,18 @@ func (a AuthenticatedResourceLocator) getGitHubFromGit() (chan Content, error) {
 	// Get the repo name itself. It's the first 2 components.
 	components := strings.Split(dest, "/")
 	if len(components) < 2 {
-		return nil, errors.New(`github destination should be "repoOwner/repoName" or "repoOwner/repoName/repoSubDir"`)
+		return "", "", "", errors.New(`github destination should be "repoOwner/repoName" or "repoOwner/repoName/repoSubDir"`)
 	}
-	repoPath := strings.Join(components[:2], "/")
+	repoPath = strings.Join(components[:2], "/")
 	if len(components) > 2 {
 		pathInRepo = strings.Join(components[2:], "/")
 	}
+	return repoPath, pathInRepo, targetBranch, nil
+}
 
-	if a.authType == "" {
-		// Public repo: stream a tarball of the tree at HEAD instead of
-		// cloning, a clone materializes the full history in memory.
-		return a.getGitHubFromTarball(repoPath, pathInRepo, targetBranch)
-	}
-
+// cloneGitTree clones the tip of a branch of the repo over ssh and returns
+// its tree. The clone is shallow but still holds the blobs of every file.
+func (a AuthenticatedResourceLocator) cloneGitTree(ctx context.Context, repoPath string, targetBranch string) (*object.Tree, error) {
 	gitOptions := git.CloneOptions{
 		URL: fmt.Sprintf("git@github.com:%s", repoPath),
 		// We only ever read the tree at the tip of one branch, a full
@@ -104,9 +132,9 @@ func (a AuthenticatedResourceLocator) getGitHubFromGit() (chan Content, error) {
 	gitOptions.Auth = pubKey
 
 	// Clone the repo in memory.
-	r, err := git.Clone(memory.NewStorage(), nil, &gitOptions)
+	r, err := git.CloneContext(ctx, memory.NewStorage(), nil, &gitOptions)
 	if err != nil {
-		return nil, fmt.Errorf("failed to clone repo: %v", err)
+		return nil, withKind(gitErrorKind(err), fmt.Errorf("failed to clone repo: %w", err))
 	}
 
 	// We default to the HEAD.
@@ -126,39 +154,124 @@ func (a AuthenticatedResourceLocator) getGitHubFromGit() (chan Content, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to get tree: %v", err)
 	}
+	return tree, nil
+}
+
+// githubSourceURI returns the URI of the file at name in the repo, at the
+// tip of targetBranch or of the default branch.
+func githubSourceURI(repoPath string, targetBranch string, name string) string {
+	ref := targetBranch
+	if ref == "" {
+		ref = "HEAD"
+	}
+	return fmt.Sprintf("https://github.com/%s/blob/%s/%s", repoPath, ref, name)
+}
+
+func gitMetadata(f *object.File) Metadata {
+	// Git only tracks the executable bit and links, other
+	// modes are left unset.
+	mode, _ := f.Mode.ToOSFileMode()
+	return Metadata{
+		Size:    f.Size,
+		Mode:    mode,
+		Version: f.Hash.String(),
+	}
+}
+
+func (a AuthenticatedResourceLocator) listGitHubFromGit(ctx context.Context) ([]Entry, error) {
+	repoPath, pathInRepo, targetBranch, err := a.parseGitDest()
+	if err != nil {
+		return nil, err
+	}
+	tree, err := a.cloneGitTree(ctx, repoPath, targetBranch)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []Entry{}
+	err = tree.Files().ForEach(func(f *object.File) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !strings.HasPrefix(f.Name, pathInRepo) || a.skipFile(relativePath(f.Name, pathInRepo), false) {
+			return nil
+		}
+		entries = append(entries, Entry{
+			FilePath:  relativePath(f.Name, pathInRepo),
+			SourceURI: githubSourceURI(repoPath, targetBranch, f.Name),
+			Metadata:  gitMetadata(f),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrorResourceNotFound, a.methodDest)
+	}
+	return entries, nil
+}
+
+func (a AuthenticatedResourceLocator) getGitHubFromGit(ctx context.Context) (chan StreamContent, error) {
+	repoPath, pathInRepo, targetBranch, err := a.parseGitDest()
+	if err != nil {
+		return nil, err
+	}
+
+	if a.authType == "" {
+		// Public repo: stream a tarball of the tree at HEAD instead of
+		// cloning, a clone materializes the full history in memory.
+		return a.getGitHubFromTarball(ctx, repoPath, pathInRepo, targetBranch)
+	}
+
+	tree, err := a.cloneGitTree(ctx, repoPath, targetBranch)
+	if err != nil {
+		return nil, err
+	}
 
 	// Start iterating through all the files.
-	chOut := make(chan Content, a.maxConcurrent)
+	chOut := make(chan StreamContent, a.maxConcurrent)
 	go func() {
-		defer close(chOut)
+		defer finishStream(ctx, chOut)
 		totalSize := uint64(0)
+		nFiles := 0
 		err := tree.Files().ForEach(func(f *object.File) error {
-			if !strings.HasPrefix(f.Name, pathInRepo) {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			filePath := relativePath(f.Name, pathInRepo)
+			if !strings.HasPrefix(f.Name, pathInRepo) || a.skipFile(filePath, false) {
 				return nil
 			}
-			if a.maxSize != 0 {
-				totalSize += uint64(f.Size)
-				if totalSize > a.maxSize {
-					return fmt.Errorf("maximum resource size reached (%d bytes)", a.maxSize)
-				}
+			nFiles++
+			totalSize += uint64(f.Size)
+			if err := checkSize(totalSize, a.maxSize); err != nil {
+				return err
+			}
+			if err := checkFiles(uint64(nFiles), a.maxFiles); err != nil {
+				return err
 			}
+			// The blob lives in the in-memory storage, readers
+			// are independent of each other.
 			reader, err := f.Blob.Reader()
 			if err != nil {
 				return fmt.Errorf("failed to get blob reader: %v", err)
 			}
-			data, err := ioutil.ReadAll(reader)
-			reader.Close()
-			if err != nil {
-				return fmt.Errorf("failed to read blob: %v", err)
-			}
-			chOut <- Content{
-				FilePath: f.Name,
-				Data:     data,
+			if !sendStream(ctx, chOut, StreamContent{
+				FilePath:  filePath,
+				SourceURI: githubSourceURI(repoPath, targetBranch, f.Name),
+				Metadata:  gitMetadata(f),
+				Reader:    reader,
+			}) {
+				return ctx.Err()
 			}
 			return nil
 		})
-		if err != nil {
-			chOut <- Content{Error: err}
+		if err == nil && nFiles == 0 {
+			err = fmt.Errorf("%w: %s", ErrorResourceNotFound, a.methodDest)
+		}
+		if err != nil && ctx.Err() == nil {
+			sendStream(ctx, chOut, StreamContent{Error: err})
 		}
 	}()
 
@@ -171,15 +284,16 @@ const tarballFetchTimeout = 30 * time.Minute
 
 // getGitHubFromTarball fetches the tree of a public GitHub repo at the tip of
 // a branch (or the default branch) as a streamed tarball. Unlike a git clone,
-// this holds at most one file in memory at a time and never fetches history.
-func (a AuthenticatedResourceLocator) getGitHubFromTarball(repoPath string, pathInRepo string, targetBranch string) (chan Content, error) {
+// this never fetches history and every file is streamed straight from the
+// tarball, the next one is only read once the current one is closed.
+func (a AuthenticatedResourceLocator) getGitHubFromTarball(ctx context.Context, repoPath string, pathInRepo string, targetBranch string) (chan StreamContent, error) {
 	ref := "HEAD"
 	if targetBranch != "" {
 		ref = fmt.Sprintf("refs/heads/%s", targetBranch)
 	}
-	url := fmt.Sprintf("https://codeload.github.com/%s/tar.gz/%s", repoPath, ref)
+	url := fmt.Sprintf("%s/%s/tar.gz/%s", a.githubCodeloadURL, repoPath, ref)
 
-	ctx, cancel := context.WithTimeout(context.Background(), tarballFetchTimeout)
+	ctx, cancel := context.WithTimeout(ctx, tarballFetchTimeout)
 	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		cancel()
@@ -187,11 +301,7 @@ func (a AuthenticatedResourceLocator) getGitHubFromTarball(repoPath string, path
 	}
 	req.Header.Set("User-Agent", "AuthenticatedResourceLocator/Go")
 
-	client := a.httpClient
-	if client == nil {
-		client = http.DefaultClient
-	}
-	resp, err := client.Do(req)
+	resp, err := a.httpClient.Do(req)
 	if err != nil {
 		cancel()
 		return nil, fmt.Errorf("failed to fetch repo tarball: %v", err)
@@ -199,7 +309,7 @@ func (a AuthenticatedResourceLocator) getGitHubFromTarball(repoPath string, path
 	if resp.StatusCode != 200 {
 		resp.Body.Close()
 		cancel()
-		return nil, fmt.Errorf("failed to fetch repo tarball %s: %s", url, resp.Status)
+		return nil, newHTTPStatusError(resp, url)
 	}
 
 	gzReader, err := gzip.NewReader(resp.Body)
@@ -209,22 +319,26 @@ func (a AuthenticatedResourceLocator) getGitHubFromTarball(repoPath string, path
 		return nil, fmt.Errorf("failed to read repo tarball: %v", err)
 	}
 
-	chOut := make(chan Content, a.maxConcurrent)
+	chOut := make(chan StreamContent, a.maxConcurrent)
 	go func() {
-		defer close(chOut)
 		defer cancel()
+		defer finishStream(ctx, chOut)
 		defer resp.Body.Close()
 		defer gzReader.Close()
 
 		totalSize := uint64(0)
+		nFiles := 0
 		tarReader := tar.NewReader(gzReader)
 		for {
 			header, err := tarReader.Next()
 			if err == io.EOF {
+				if nFiles == 0 {
+					sendStream(ctx, chOut, StreamContent{Error: fmt.Errorf("%w: %s", ErrorResourceNotFound, a.methodDest)})
+				}
 				return
 			}
 			if err != nil {
-				chOut <- Content{Error: fmt.Errorf("failed to read repo tarball: %v", err)}
+				sendStream(ctx, chOut, StreamContent{Error: fmt.Errorf("failed to read repo tarball: %v", err)})
 				return
 			}
 			// We only care about regular files.
@@ -242,21 +356,31 @@ func (a AuthenticatedResourceLocator) getGitHubFromTarball(repoPath string, path
 			if name == "" || !strings.HasPrefix(name, pathInRepo) {
 				continue
 			}
-			if a.maxSize != 0 {
-				totalSize += uint64(header.Size)
-				if totalSize > a.maxSize {
-					chOut <- Content{Error: fmt.Errorf("maximum resource size reached (%d bytes)", a.maxSize)}
-					return
-				}
+			filePath := relativePath(name, pathInRepo)
+			if a.skipFile(filePath, false) {
+				continue
 			}
-			data, err := io.ReadAll(tarReader)
-			if err != nil {
-				chOut <- Content{FilePath: name, Error: fmt.Errorf("failed to read %s from repo tarball: %v", name, err)}
+			nFiles++
+			totalSize += uint64(header.Size)
+			if err := checkSize(totalSize, a.maxSize); err != nil {
+				sendStream(ctx, chOut, StreamContent{Error: err})
+				return
+			}
+			if err := checkFiles(uint64(nFiles), a.maxFiles); err != nil {
+				sendStream(ctx, chOut, StreamContent{Error: err})
 				return
 			}
-			chOut <- Content{
-				FilePath: name,
-				Data:     data,
+			entry := newEntryReader(tarReader)
+			if !sendStream(ctx, chOut, StreamContent{
+				FilePath:  filePath,
+				SourceURI: githubSourceURI(repoPath, targetBranch, name),
+				Metadata:  tarMetadata(header),
+				Reader:    entry,
+			}) {
+				return
+			}
+			if !entry.wait(ctx) {
+				return
 			}
 		}
 	}()
@@ -264,13 +388,16 @@ func (a AuthenticatedResourceLocator) getGitHubFromTarball(repoPath string, path
 	return chOut, nil
 }
 
-func (a AuthenticatedResourceLocator) getGitHubFromAPI() (chan Content, error) {
+// listGitHubAPIFiles lists the files selected by the ARL through the
+// contents API, single being true when the destination is a single file,
+// along with the headers to download them with.
+func (a AuthenticatedResourceLocator) listGitHubAPIFiles(ctx context.Context) (paths []githubFileRecord, single bool, authHeaders http.Header, err error) {
 	repoParams := ""
 
 	if strings.Contains(a.methodDest, "?") {
 		components := strings.SplitN(a.methodDest, "?", 2)
 		if len(components) != 2 {
-			return nil, errors.New("invalid github path")
+			return nil, false, nil, errors.New("invalid github path")
 		}
 		newRoot := components[0]
 		repoParams = components[1]
@@ -286,7 +413,7 @@ func (a AuthenticatedResourceLocator) getGitHubFromAPI() (chan Content, error) {
 	} else if len(components) == 3 {
 		repoPath = components[2]
 	} else {
-		return nil, errors.New(`github destination should be "repoOwner/repoName" or "repoOwner/repoName/repoSubDir"`)
+		return nil, false, nil, errors.New(`github destination should be "repoOwner/repoName" or "repoOwner/repoName/repoSubDir"`)
 	}
 
 	repoOwner := components[0]
@@ -294,34 +421,89 @@ func (a AuthenticatedResourceLocator) getGitHubFromAPI() (chan Content, error) {
 
 	repoPath = strings.TrimSuffix(repoPath, "/")
 
-	fullURL := fmt.Sprintf("https://api.github.com/repos/%s/%s/contents/", repoOwner, repoName)
+	fullURL := fmt.Sprintf("%s/repos/%s/%s/contents/", a.githubAPIURL, repoOwner, repoName)
 
-	authHeaders := http.Header{}
+	authHeaders = http.Header{}
 	if a.authType == "" {
 		// Nothing to do.
 	} else if a.authType == "token" {
 		authHeaders.Add("Authorization", fmt.Sprintf("token %s", a.authData))
 	} else {
-		return nil, ErrorAuthNotImplemented
+		return nil, false, nil, ErrorAuthNotImplemented
 	}
 
-	paths, err := listGithubFiles(a.maxSize, fullURL, authHeaders, repoPath, repoParams)
+	listed, err := a.listGithubFiles(ctx, fullURL, authHeaders, repoPath, repoParams)
 
+	if err != nil {
+		return nil, false, nil, err
+	}
+
+	single = len(listed) == 1
+	for _, p := range listed {
+		// From here on the path is the FilePath, relative to the
+		// directory of the ARL.
+		p.Path = relativePath(p.Path, repoPath)
+		if !a.skipFile(p.Path, single) {
+			paths = append(paths, p)
+		}
+	}
+
+	if len(paths) == 0 {
+		return nil, false, nil, fmt.Errorf("%w: %s", ErrorResourceNotFound, a.methodDest)
+	}
+	return paths, single, authHeaders, nil
+}
+
+func (a AuthenticatedResourceLocator) listGitHubFromAPI(ctx context.Context) ([]Entry, error) {
+	paths, single, _, err := a.listGitHubAPIFiles(ctx)
 	if err != nil {
 		return nil, err
 	}
+	entries := []Entry{}
+	for _, p := range paths {
+		entries = append(entries, Entry{
+			FilePath:  p.Path,
+			SourceURI: redactURL(p.DownloadURL),
+			Metadata:  p.metadata(),
+			Unpack:    single,
+		})
+	}
+	return entries, nil
+}
+
+func (a AuthenticatedResourceLocator) getGitHubFromAPI(ctx context.Context) (chan StreamContent, error) {
+	paths, single, authHeaders, err := a.listGitHubAPIFiles(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	totalSize := uint64(0)
+	for _, p := range paths {
+		totalSize += uint64(p.Size)
+	}
+	if err := checkSize(totalSize, a.maxSize); err != nil {
+		return nil, err
+	}
+	if err := checkFiles(uint64(len(paths)), a.maxFiles); err != nil {
+		return nil, err
+	}
 
 	// If we have a single content, multiplex it.
-	if len(paths) == 1 {
-		data, err := downloadGithubFile(paths[0].DownloadURL, authHeaders)
+	if single {
+		reader, err := a.openGithubFile(ctx, paths[0].DownloadURL, authHeaders)
 		if err != nil {
 			return nil, err
 		}
-		tmpContent := Content{
-			FilePath: paths[0].Path,
-			Data:     data,
+		chOut := make(chan StreamContent, 1)
+		chOut <- StreamContent{
+			FilePath:  paths[0].Path,
+			SourceURI: redactURL(paths[0].DownloadURL),
+			Metadata:  paths[0].metadata(),
+			Reader:    reader,
+			Unpack:    true,
 		}
-		return multiplexContent(tmpContent), nil
+		close(chOut)
+		return chOut, nil
 	}
 
 	chIn := make(chan githubFileRecord, len(paths))
@@ -331,7 +513,7 @@ func (a AuthenticatedResourceLocator) getGitHubFromAPI() (chan Content, error) {
 	}
 	close(chIn)
 
-	chOut := make(chan Content, a.maxConcurrent)
+	chOut := make(chan StreamContent, a.maxConcurrent)
 	wg := sync.WaitGroup{}
 
 	for i := 0; uint64(i) < a.maxConcurrent; i++ {
@@ -341,35 +523,39 @@ func (a AuthenticatedResourceLocator) getGitHubFromAPI() (chan Content, error) {
 			defer wg.Done()
 
 			for gr := range chIn {
-				tmpContent := Content{
-					FilePath: gr.Path,
+				tmpContent := StreamContent{
+					FilePath:  gr.Path,
+					SourceURI: redactURL(gr.DownloadURL),
+					Metadata:  gr.metadata(),
 				}
-				data, err := downloadGithubFile(gr.DownloadURL, authHeaders)
+				reader, err := a.openGithubFile(ctx, gr.DownloadURL, authHeaders)
 				if err != nil {
 					tmpContent.Error = err
-					chOut <- tmpContent
+					sendStream(ctx, chOut, tmpContent)
+					return
+				}
+				tmpContent.Reader = reader
+				if !sendStream(ctx, chOut, tmpContent) {
 					return
 				}
-				tmpContent.Data = data
-				chOut <- tmpContent
 			}
 		}()
 	}
 
 	go func() {
 		wg.Wait()
-		close(chOut)
+		finishStream(ctx, chOut)
 	}()
 
 	return chOut, nil
 }
 
-func listGithubFiles(maxSize uint64, baseURL string, auth http.Header, subPath string, repoParams string) ([]githubFileRecord, error) {
+func (a AuthenticatedResourceLocator) listGithubFiles(ctx context.Context, baseURL string, auth http.Header, subPath string, repoParams string) ([]githubFileRecord, error) {
 	outPaths := []githubFileRecord{}
 
 	thisURL := fmt.Sprintf("%s%s%s", baseURL, subPath, repoParams)
-	fmt.Println(thisURL)
-	body, err := downloadGithubFile(thisURL, auth)
+	a.logger.Debug("listing github files", "url", thisURL)
+	body, err := a.downloadGithubFile(ctx, thisURL, auth)
 	if err != nil {
 		return outPaths, err
 	}
@@ -410,7 +596,7 @@ func listGithubFiles(maxSize uint64, baseURL string, auth http.Header, subPath s
 				return outPaths, errors.New("github data missing path")
 			}
 
-			subPaths, err := listGithubFiles(maxSize, baseURL, auth, thisPath, repoParams)
+			subPaths, err := a.listGithubFiles(ctx, baseURL, auth, thisPath, repoParams)
 			outPaths = append(outPaths, subPaths...)
 			if err != nil {
 				return outPaths, err
@@ -440,13 +626,18 @@ func listGithubFiles(maxSize uint64, baseURL string, auth http.Header, subPath s
 				return outPaths, errors.New("github data missing download_url")
 			}
 
+			// The sha is informational, it is not required.
+			thisSHA, _ := fileEntry["sha"].(string)
+
 			if entrySize != 0 {
-				if maxSize != 0 && uint64(entrySize) > maxSize {
-					return outPaths, errors.New("Maximum resurce size reached.")
+				if err := checkSize(uint64(entrySize), a.maxSize); err != nil {
+					return outPaths, err
 				}
 				outPaths = append(outPaths, githubFileRecord{
 					Path:        thisPath,
 					DownloadURL: thisDownload,
+					Size:        int64(entrySize),
+					SHA:         thisSHA,
 				})
 			}
 		}
@@ -455,12 +646,22 @@ func listGithubFiles(maxSize uint64, baseURL string, auth http.Header, subPath s
 	return outPaths, nil
 }
 
-func downloadGithubFile(url string, auth http.Header) ([]byte, error) {
-	data := []byte{}
+func (a AuthenticatedResourceLocator) downloadGithubFile(ctx context.Context, url string, auth http.Header) ([]byte, error) {
+	reader, err := a.openGithubFile(ctx, url, auth)
+	if err != nil {
+		return []byte{}, err
+	}
+	defer reader.Close()
+
+	return ioutil.ReadAll(reader)
+}
 
-	req, err := http.NewRequest("GET", url, nil)
+// openGithubFile issues the GET for url and returns the response body,
+// which the caller must close.
+func (a AuthenticatedResourceLocator) openGithubFile(ctx context.Context, url string, auth http.Header) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
-		return data, err
+		return nil, err
 	}
 
 	// Copy the headers since they're not thread safe.
@@ -471,21 +672,27 @@ func downloadGithubFile(url string, auth http.Header) ([]byte, error) {
 	req.Header = headers
 	req.Header.Set("User-Agent", "AuthenticatedResourceLocator/Go")
 
-	client := http.Client{}
-
-	resp, err := client.Do(req)
+	resp, err := a.httpClient.Do(req)
 	if err != nil {
-		return data, err
+		return nil, err
 	}
 
 	if resp.StatusCode != 200 {
-		return data, fmt.Errorf("failed to get resource %s: %s", url, resp.Status)
+		resp.Body.Close()
+		return nil, newHTTPStatusError(resp, url)
 	}
 
-	data, err = ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return data, err
-	}
+	return resp.Body, nil
+}
 
-	return data, nil
+// gitErrorKind maps the errors of go-git to the matching sentinel error,
+// if any.
+func gitErrorKind(err error) error {
+	if errors.Is(err, transport.ErrRepositoryNotFound) || errors.Is(err, plumbing.ErrReferenceNotFound) {
+		return ErrorResourceNotFound
+	}
+	if errors.Is(err, transport.ErrAuthenticationRequired) || errors.Is(err, transport.ErrAuthorizationFailed) {
+		return ErrorUnauthorized
+	}
+	return nil
 }
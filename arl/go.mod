@@ -4,7 +4,11 @@ go 1.25.0
 
 require (
 	cloud.google.com/go/storage v1.56.0
+	github.com/bmatcuk/doublestar/v4 v4.10.0
 	github.com/go-git/go-git/v5 v5.19.1
+	github.com/klauspost/compress v1.18.0
+	github.com/ulikunitz/xz v0.5.15
+	go.uber.org/goleak v1.3.0
 	google.golang.org/api v0.246.0
 )
 
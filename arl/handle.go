@@ -0,0 +1,116 @@
+// *************************************************************************
+//
+// REFRACTION POINT CONFIDENTIAL
+// __________________
+//
+//  Copyright 2018 Refraction Point Inc.
+//  All Rights Reserved.
+//
+// NOTICE:  All information contained herein is, and remains
+// the property of Refraction Point Inc. and its suppliers,
+// if any.  The intellectual and technical concepts contained
+// herein are proprietary to Refraction Point Inc
+// and its suppliers and may be covered by U.S. and Foreign Patents,
+// patents in process, and are protected by trade secret or copyright law.
+// Dissemination of this information or reproduction of this material
+// is strictly forbidden unless prior written permission is obtained
+// from Refraction Point Inc.
+//
+
+package arl
+
+import (
+	"context"
+	"errors"
+	"iter"
+	"sync"
+)
+
+// FetchHandle is a fetch started by Start. The consumer can stop at any
+// time by calling Close, which must be called in any case once done.
+type FetchHandle struct {
+	ch     chan Content
+	cancel context.CancelFunc
+	once   sync.Once
+}
+
+// Start starts fetching the resources like FetchContext does, returning a
+// handle on the fetch rather than a bare channel so that the consumer can
+// abandon it without leaking anything.
+func (a *AuthenticatedResourceLocator) Start(ctx context.Context) (*FetchHandle, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	ch, err := a.FetchContext(ctx)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &FetchHandle{
+		ch:     ch,
+		cancel: cancel,
+	}, nil
+}
+
+// Contents returns the channel the resources are produced on, it is closed
+// once the fetch is complete or closed.
+func (h *FetchHandle) Contents() <-chan Content {
+	return h.ch
+}
+
+// Close stops the fetch: in-flight requests are aborted and the bodies,
+// readers and clients of the backends released. It returns once every
+// producer is done, the Contents not received yet are dropped.
+func (h *FetchHandle) Close() error {
+	h.once.Do(func() {
+		h.cancel()
+		for range h.ch {
+		}
+	})
+	return nil
+}
+
+// All returns an iterator over the resources fetched, which stops the fetch
+// when the loop is exited early. The files which could not be fetched are
+// produced with their Content.Error set while the error is nil. An error
+// aborting the whole fetch is produced as the error instead, as the last
+// element, along with the Content it came with if any.
+func (a *AuthenticatedResourceLocator) All(ctx context.Context) iter.Seq2[Content, error] {
+	return func(yield func(Content, error) bool) {
+		h, err := a.Start(ctx)
+		if err != nil {
+			yield(Content{}, err)
+			return
+		}
+		defer h.Close()
+		for c := range h.Contents() {
+			if c.Error != nil && a.isFatal(c.FilePath, c.Error) {
+				yield(c, c.Error)
+				return
+			}
+			if !yield(c, nil) {
+				return
+			}
+		}
+		// A cancelled fetch is not always reported on the channel.
+		if err := ctx.Err(); err != nil {
+			yield(Content{}, err)
+		}
+	}
+}
+
+// isFatal reports whether err, produced for the file at filePath, aborts
+// the fetch rather than only concerning that file. Unsafe paths abort it
+// when the UnpackOptions reject them.
+func (a AuthenticatedResourceLocator) isFatal(filePath string, err error) bool {
+	if filePath == "" {
+		return true
+	}
+	if a.unpackOptions.RejectUnsafePaths && errors.Is(err, ErrorUnsafePath) {
+		return true
+	}
+	for _, fatal := range []error{ErrorMaxSizeExceeded, ErrorMaxFilesExceeded, ErrorArchiveLimitExceeded, context.Canceled, context.DeadlineExceeded} {
+		if errors.Is(err, fatal) {
+			return true
+		}
+	}
+	return false
+}
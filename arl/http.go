@@ -20,14 +20,15 @@
 package arl
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"net/http"
+	"path"
 	"strings"
 )
 
-func (a AuthenticatedResourceLocator) getHTTP() (chan Content, error) {
+func (a AuthenticatedResourceLocator) getHTTP(ctx context.Context) (chan StreamContent, error) {
 	fullURL := ""
 	if a.methodName == "http" {
 		fullURL = fmt.Sprintf("http://%s", a.methodDest)
@@ -37,11 +38,20 @@ func (a AuthenticatedResourceLocator) getHTTP() (chan Content, error) {
 		return nil, ErrorMethodNotImplemented
 	}
 
-	req, err := http.NewRequest("GET", fullURL, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", fullURL, nil)
 	if err != nil {
 		return nil, err
 	}
 
+	// The destination is the file itself.
+	filePath := path.Base(req.URL.Path)
+	if filePath == "/" || filePath == "." {
+		filePath = req.URL.Hostname()
+	}
+	if a.skipFile(filePath, true) {
+		return nil, fmt.Errorf("%w: %s is filtered out", ErrorResourceNotFound, redactURL(fullURL))
+	}
+
 	if a.authType == "basic" {
 		components := strings.Split(a.authData, ":")
 		if len(components) != 2 {
@@ -62,18 +72,38 @@ func (a AuthenticatedResourceLocator) getHTTP() (chan Content, error) {
 	}
 
 	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("failed to get url: %s", resp.Status)
+		resp.Body.Close()
+		return nil, newHTTPStatusError(resp, fullURL)
 	}
-
-	b, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
+	if resp.ContentLength > 0 {
+		if err := checkSize(uint64(resp.ContentLength), a.maxSize); err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
 	}
 
-	bodyContent := Content{
-		FilePath: fullURL,
-		Data:     b,
+	chOut := make(chan StreamContent, 1)
+	chOut <- StreamContent{
+		FilePath:  filePath,
+		SourceURI: redactURL(fullURL),
+		Metadata:  httpMetadata(resp),
+		Reader:    resp.Body,
+		Unpack:    true,
 	}
+	close(chOut)
+
+	return chOut, nil
+}
 
-	return multiplexContent(bodyContent), nil
+// httpMetadata returns the Metadata described by the headers of resp.
+func httpMetadata(resp *http.Response) Metadata {
+	m := Metadata{
+		Size:        resp.ContentLength,
+		Version:     resp.Header.Get("ETag"),
+		ContentType: resp.Header.Get("Content-Type"),
+	}
+	if lastModified, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		m.ModTime = lastModified
+	}
+	return m
 }
@@ -0,0 +1,160 @@
+// *************************************************************************
+//
+// REFRACTION POINT CONFIDENTIAL
+// __________________
+//
+//  Copyright 2018 Refraction Point Inc.
+//  All Rights Reserved.
+//
+// NOTICE:  All information contained herein is, and remains
+// the property of Refraction Point Inc. and its suppliers,
+// if any.  The intellectual and technical concepts contained
+// herein are proprietary to Refraction Point Inc
+// and its suppliers and may be covered by U.S. and Foreign Patents,
+// patents in process, and are protected by trade secret or copyright law.
+// Dissemination of this information or reproduction of this material
+// is strictly forbidden unless prior written permission is obtained
+// from Refraction Point Inc.
+//
+
+package arl
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync/atomic"
+)
+
+// errMaxSize is the error reported by every backend when the resources
+// fetched exceed maxSize.
+func errMaxSize(maxSize uint64) error {
+	return fmt.Errorf("%w (%d bytes)", ErrorMaxSizeExceeded, maxSize)
+}
+
+// checkSize is the up front check done by backends which know the size
+// of what they are about to fetch. A zero maxSize is unlimited.
+func checkSize(size uint64, maxSize uint64) error {
+	if maxSize != 0 && size > maxSize {
+		return errMaxSize(maxSize)
+	}
+	return nil
+}
+
+// errMaxFiles is the error reported when more than maxFiles files would
+// be fetched.
+func errMaxFiles(maxFiles uint64) error {
+	return fmt.Errorf("%w (%d files)", ErrorMaxFilesExceeded, maxFiles)
+}
+
+// checkFiles is the up front check done by backends which know how many
+// files they are about to fetch. A zero maxFiles is unlimited.
+func checkFiles(n uint64, maxFiles uint64) error {
+	if maxFiles != 0 && n > maxFiles {
+		return errMaxFiles(maxFiles)
+	}
+	return nil
+}
+
+// sizeBudget accounts for the bytes actually read by all the resources of
+// a single fetch. A zero maxSize is unlimited.
+type sizeBudget struct {
+	maxSize uint64
+	used    atomic.Uint64
+}
+
+func (b *sizeBudget) consume(n uint64) error {
+	return checkSize(b.used.Add(n), b.maxSize)
+}
+
+type budgetReader struct {
+	io.ReadCloser
+	budget *sizeBudget
+}
+
+func (r *budgetReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		if errBudget := r.budget.consume(uint64(n)); errBudget != nil {
+			return n, errBudget
+		}
+	}
+	return n, err
+}
+
+// limitStream charges every reader of chIn against a sizeBudget of
+// maxSize, so that no backend can read past it even when the sizes
+// it announced were wrong or missing.
+func limitStream(ctx context.Context, chIn chan StreamContent, maxSize uint64) chan StreamContent {
+	if maxSize == 0 {
+		return chIn
+	}
+	budget := &sizeBudget{maxSize: maxSize}
+	chOut := make(chan StreamContent, cap(chIn))
+
+	go func() {
+		defer close(chOut)
+		for s := range chIn {
+			if s.Reader != nil {
+				s.Reader = &budgetReader{
+					ReadCloser: s.Reader,
+					budget:     budget,
+				}
+			}
+			if !sendStream(ctx, chOut, s) {
+				break
+			}
+		}
+		for s := range chIn {
+			if s.Reader != nil {
+				s.Reader.Close()
+			}
+		}
+	}()
+
+	return chOut
+}
+
+// limitFiles stops the stream with an error once more than maxFiles files
+// went through, whatever the backends and archives announced. The producers
+// of chIn are stopped with cancel as soon as the stream is over rather than
+// left to read the rest of the source, chOut is closed once they are done.
+// A zero maxFiles is unlimited. A stream ending without producing anything,
+// like when the filter selects none of the files, gets notFound instead.
+func limitFiles(ctx context.Context, cancel context.CancelFunc, chIn chan StreamContent, maxFiles uint64, notFound error) chan StreamContent {
+	chOut := make(chan StreamContent, cap(chIn))
+
+	go func() {
+		nFiles := uint64(0)
+		isEmpty := true
+		for s := range chIn {
+			isEmpty = false
+			if s.Error == nil {
+				nFiles++
+			}
+			if err := checkFiles(nFiles, maxFiles); err != nil {
+				if s.Reader != nil {
+					s.Reader.Close()
+				}
+				sendStream(ctx, chOut, StreamContent{Error: err})
+				break
+			}
+			if !sendStream(ctx, chOut, s) {
+				break
+			}
+		}
+		if isEmpty && ctx.Err() == nil {
+			sendStream(ctx, chOut, StreamContent{Error: notFound})
+		}
+		// Once cancelled, the producers stop right away.
+		cancel()
+		for s := range chIn {
+			if s.Reader != nil {
+				s.Reader.Close()
+			}
+		}
+		close(chOut)
+	}()
+
+	return chOut
+}
@@ -0,0 +1,110 @@
+// *************************************************************************
+//
+// REFRACTION POINT CONFIDENTIAL
+// __________________
+//
+//  Copyright 2018 Refraction Point Inc.
+//  All Rights Reserved.
+//
+// NOTICE:  All information contained herein is, and remains
+// the property of Refraction Point Inc. and its suppliers,
+// if any.  The intellectual and technical concepts contained
+// herein are proprietary to Refraction Point Inc
+// and its suppliers and may be covered by U.S. and Foreign Patents,
+// patents in process, and are protected by trade secret or copyright law.
+// Dissemination of this information or reproduction of this material
+// is strictly forbidden unless prior written permission is obtained
+// from Refraction Point Inc.
+//
+
+package arl
+
+import (
+	"context"
+	"errors"
+	"slices"
+)
+
+// Entry is a resource as listed by List, without its data.
+type Entry struct {
+	// FilePath and SourceURI are as described for Content.
+	FilePath  string
+	SourceURI string
+	Metadata
+	// Unpack has the same meaning as in StreamContent.
+	Unpack bool
+}
+
+// Lister is implemented by the Methods which can enumerate the resources
+// of an ARL without downloading them. List may return an error wrapping
+// errors.ErrUnsupported when it cannot do so for a given ARL, the
+// resources are then fetched to be listed.
+type Lister interface {
+	List(ctx context.Context, a AuthenticatedResourceLocator) ([]Entry, error)
+}
+
+// List returns the paths and metadata of the files Fetch would produce,
+// without downloading them when the method can list its resources. When
+// the resources have to be fetched, like over HTTP, for public GitHub repos
+// or to list the files of an archive, their data is skipped over rather
+// than buffered, except for zip archives which are buffered to be read.
+// GitHub repos accessed over ssh are cloned, their files included.
+func (a *AuthenticatedResourceLocator) List(ctx context.Context) ([]Entry, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	lister, ok := a.method.(Lister)
+	if !ok {
+		return a.listStream(ctx)
+	}
+	entries, err := lister.List(ctx, *a)
+	if errors.Is(err, errors.ErrUnsupported) {
+		return a.listStream(ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Archives can only be listed by reading them.
+	if slices.ContainsFunc(entries, func(e Entry) bool {
+		return shouldUnpack(a.unpackOptions.Mode, e.Unpack)
+	}) {
+		return a.listStream(ctx)
+	}
+	return entries, nil
+}
+
+// listStream lists the resources by fetching them, closing each one
+// without reading it.
+func (a *AuthenticatedResourceLocator) listStream(ctx context.Context) ([]Entry, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	ch, err := a.FetchStream(ctx)
+	if err != nil {
+		return nil, err
+	}
+	entries := []Entry{}
+	for s := range ch {
+		if s.Reader != nil {
+			s.Reader.Close()
+		}
+		if s.Error != nil {
+			err = s.Error
+			break
+		}
+		entries = append(entries, Entry{
+			FilePath:  s.FilePath,
+			SourceURI: s.SourceURI,
+			Metadata:  s.Metadata,
+		})
+	}
+	if err != nil {
+		cancel()
+		for s := range ch {
+			if s.Reader != nil {
+				s.Reader.Close()
+			}
+		}
+		return nil, err
+	}
+	return entries, nil
+}
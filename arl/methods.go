@@ -0,0 +1,102 @@
+// *************************************************************************
+//
+// REFRACTION POINT CONFIDENTIAL
+// __________________
+//
+//  Copyright 2018 Refraction Point Inc.
+//  All Rights Reserved.
+//
+// NOTICE:  All information contained herein is, and remains
+// the property of Refraction Point Inc. and its suppliers,
+// if any.  The intellectual and technical concepts contained
+// herein are proprietary to Refraction Point Inc
+// and its suppliers and may be covered by U.S. and Foreign Patents,
+// patents in process, and are protected by trade secret or copyright law.
+// Dissemination of this information or reproduction of this material
+// is strictly forbidden unless prior written permission is obtained
+// from Refraction Point Inc.
+//
+
+package arl
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+)
+
+// Method implements the fetching of the resources for one ARL method.
+type Method interface {
+	// AuthTypes lists the auth types the method supports, an empty
+	// string meaning no authentication.
+	AuthTypes() []string
+	// Fetch starts fetching the resources of a. The returned channel
+	// must be closed once all the resources have been produced and
+	// producing must stop when ctx is done.
+	Fetch(ctx context.Context, a AuthenticatedResourceLocator) (chan StreamContent, error)
+}
+
+var methodsMutex sync.RWMutex
+var methods = map[string]Method{}
+
+// RegisterMethod makes a method available to the ARLs created afterwards
+// under name, which is case insensitive. Registering a name again replaces
+// the previous method.
+func RegisterMethod(name string, m Method) {
+	if m == nil {
+		panic("arl: RegisterMethod with a nil method")
+	}
+	methodsMutex.Lock()
+	defer methodsMutex.Unlock()
+	methods[strings.ToLower(name)] = m
+}
+
+func getMethod(name string) (Method, bool) {
+	methodsMutex.RLock()
+	defer methodsMutex.RUnlock()
+	m, ok := methods[name]
+	return m, ok
+}
+
+// builtinMethod adapts the backends of this package to the Method interface.
+type builtinMethod struct {
+	authTypes []string
+	fetch     func(a AuthenticatedResourceLocator, ctx context.Context) (chan StreamContent, error)
+	// list is nil for the backends which cannot list their resources.
+	list func(a AuthenticatedResourceLocator, ctx context.Context) ([]Entry, error)
+}
+
+func (m builtinMethod) AuthTypes() []string {
+	return m.authTypes
+}
+
+func (m builtinMethod) Fetch(ctx context.Context, a AuthenticatedResourceLocator) (chan StreamContent, error) {
+	return m.fetch(a, ctx)
+}
+
+func (m builtinMethod) List(ctx context.Context, a AuthenticatedResourceLocator) ([]Entry, error) {
+	if m.list == nil {
+		return nil, errors.ErrUnsupported
+	}
+	return m.list(a, ctx)
+}
+
+func init() {
+	httpMethod := builtinMethod{
+		authTypes: []string{"basic", "bearer", "token", "otx", ""},
+		fetch:     AuthenticatedResourceLocator.getHTTP,
+	}
+	RegisterMethod("http", httpMethod)
+	RegisterMethod("https", httpMethod)
+	RegisterMethod("gcs", builtinMethod{
+		authTypes: []string{"gaia"},
+		fetch:     AuthenticatedResourceLocator.getGCS,
+		list:      AuthenticatedResourceLocator.listGCS,
+	})
+	RegisterMethod("github", builtinMethod{
+		authTypes: []string{"token", "ssh", ""},
+		fetch:     AuthenticatedResourceLocator.getGitHub,
+		list:      AuthenticatedResourceLocator.listGitHub,
+	})
+}
@@ -0,0 +1,105 @@
+// *************************************************************************
+//
+// REFRACTION POINT CONFIDENTIAL
+// __________________
+//
+//  Copyright 2018 Refraction Point Inc.
+//  All Rights Reserved.
+//
+// NOTICE:  All information contained herein is, and remains
+// the property of Refraction Point Inc. and its suppliers,
+// if any.  The intellectual and technical concepts contained
+// herein are proprietary to Refraction Point Inc
+// and its suppliers and may be covered by U.S. and Foreign Patents,
+// patents in process, and are protected by trade secret or copyright law.
+// Dissemination of this information or reproduction of this material
+// is strictly forbidden unless prior written permission is obtained
+// from Refraction Point Inc.
+//
+
+package arl
+
+import (
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// Option configures the AuthenticatedResourceLocator created by New.
+type Option func(a *AuthenticatedResourceLocator) error
+
+// WithMaxSize limits the number of bytes fetched, 0 being unlimited.
+func WithMaxSize(maxSize uint64) Option {
+	return func(a *AuthenticatedResourceLocator) error {
+		a.maxSize = maxSize
+		return nil
+	}
+}
+
+// WithMaxConcurrent sets the maximum number of concurrent requests, at
+// least one request is always made.
+func WithMaxConcurrent(maxConcurrent uint64) Option {
+	return func(a *AuthenticatedResourceLocator) error {
+		a.maxConcurrent = max(maxConcurrent, 1)
+		return nil
+	}
+}
+
+// WithHTTPClient sets the client of the HTTP requests, nil meaning
+// http.DefaultClient.
+func WithHTTPClient(client *http.Client) Option {
+	return func(a *AuthenticatedResourceLocator) error {
+		if client == nil {
+			client = http.DefaultClient
+		}
+		a.httpClient = client
+		return nil
+	}
+}
+
+// WithGitHubURLs replaces the base URLs of the GitHub REST API and of the
+// repo tarballs, DefaultGitHubAPIURL and DefaultGitHubCodeloadURL, for
+// instance to use GitHub Enterprise or a test server.
+func WithGitHubURLs(apiURL string, codeloadURL string) Option {
+	return func(a *AuthenticatedResourceLocator) error {
+		a.githubAPIURL = strings.TrimSuffix(apiURL, "/")
+		a.githubCodeloadURL = strings.TrimSuffix(codeloadURL, "/")
+		return nil
+	}
+}
+
+// WithLogger sets the logger the fetches report to, nothing is logged by
+// default.
+func WithLogger(logger *slog.Logger) Option {
+	return func(a *AuthenticatedResourceLocator) error {
+		if logger == nil {
+			logger = slog.New(slog.DiscardHandler)
+		}
+		a.logger = logger
+		return nil
+	}
+}
+
+// WithMaxFiles limits the number of files fetched, 0 being unlimited.
+func WithMaxFiles(maxFiles uint64) Option {
+	return func(a *AuthenticatedResourceLocator) error {
+		a.maxFiles = maxFiles
+		return nil
+	}
+}
+
+// WithUnpackOptions sets how archives are unpacked.
+func WithUnpackOptions(opts UnpackOptions) Option {
+	return func(a *AuthenticatedResourceLocator) error {
+		a.SetUnpackOptions(opts)
+		return nil
+	}
+}
+
+// WithFilter sets the Filter selecting the files to fetch, replacing the
+// one given in the ARL options.
+func WithFilter(f Filter) Option {
+	return func(a *AuthenticatedResourceLocator) error {
+		return a.SetFilter(f)
+	}
+}
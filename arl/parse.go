@@ -0,0 +1,195 @@
+// *************************************************************************
+//
+// REFRACTION POINT CONFIDENTIAL
+// __________________
+//
+//  Copyright 2018 Refraction Point Inc.
+//  All Rights Reserved.
+//
+// NOTICE:  All information contained herein is, and remains
+// the property of Refraction Point Inc. and its suppliers,
+// if any.  The intellectual and technical concepts contained
+// herein are proprietary to Refraction Point Inc
+// and its suppliers and may be covered by U.S. and Foreign Patents,
+// patents in process, and are protected by trade secret or copyright law.
+// Dissemination of this information or reproduction of this material
+// is strictly forbidden unless prior written permission is obtained
+// from Refraction Point Inc.
+//
+
+package arl
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// ARL is the structured form of an ARL string.
+type ARL struct {
+	Method      string
+	Destination string
+	// AuthType and AuthData are empty when no authentication is used.
+	AuthType string
+	AuthData string
+	// Options holds the optional last component, "key=value" pairs
+	// separated by "&". The include and exclude keys give the patterns
+	// of the Filter, and can be repeated.
+	Options string
+}
+
+// Parse parses an ARL string, either in the "[method,dest,authType,authData]"
+// form or the "https://..." shortcut. The method and auth type are
+// lowercased but not validated against the supported methods. Options can
+// be given as a last component, as in "[method,dest,options]" or
+// "[method,dest,authType,authData,options]".
+//
+// Within the brackets, a backslash escapes a following "\", ",", "[", "]"
+// or whitespace character so that components can contain them. The
+// whitespace around a component is trimmed, except for escaped whitespace.
+// A backslash followed by any other character is kept as-is.
+func Parse(arl string) (ARL, error) {
+	a := ARL{}
+
+	if strings.HasPrefix(arl, "https://") {
+		// This is a shortcut for backwards compatibility.
+		a.Method = "https"
+		a.Destination = arl[len("https://"):]
+		return a, nil
+	}
+
+	if !strings.HasPrefix(arl, "[") || !strings.HasSuffix(arl, "]") {
+		return a, ErrorInvalidFormat
+	}
+	// Remove prefix and suffix.
+	arl = arl[1 : len(arl)-1]
+	// Split the ARL into its components.
+	components := splitComponents(arl)
+	if len(components) < 2 || len(components) > 5 {
+		return a, ErrorInvalidFormat
+	}
+	// Remove any unneeded spaces and resolve the escapes.
+	for i := range components {
+		components[i] = unescapeComponent(trimComponent(components[i]))
+	}
+	// Load the components in order.
+	a.Method = strings.ToLower(components[0])
+	a.Destination = components[1]
+	if len(components) >= 4 {
+		a.AuthType = strings.ToLower(components[2])
+		a.AuthData = components[3]
+	}
+	if len(components)%2 == 1 {
+		a.Options = components[len(components)-1]
+		if _, err := parseOptions(a.Options); err != nil {
+			return a, err
+		}
+	}
+
+	return a, nil
+}
+
+// String returns the canonical "[method,dest,authType,authData]" form of
+// the ARL, or "[method,dest]" when there is no authentication, followed
+// by the options if any. The auth data is included as-is, only escaped, so
+// that Parse gives the ARL back: use Redacted to log or display it.
+func (a ARL) String() string {
+	components := []string{a.Method, a.Destination}
+	if a.AuthType != "" || a.AuthData != "" {
+		components = append(components, a.AuthType, a.AuthData)
+	}
+	if a.Options != "" {
+		components = append(components, a.Options)
+	}
+	for i := range components {
+		components[i] = escapeComponent(components[i])
+	}
+	return fmt.Sprintf("[%s]", strings.Join(components, ","))
+}
+
+// Filter returns the Filter described by the options.
+func (a ARL) Filter() (Filter, error) {
+	return parseOptions(a.Options)
+}
+
+func isEscapable(r rune) bool {
+	return r == '\\' || r == ',' || r == '[' || r == ']' || unicode.IsSpace(r)
+}
+
+// escapedAt returns the length of the escape sequence starting at s[i],
+// or 0 if there is none.
+func escapedAt(s string, i int) int {
+	if s[i] != '\\' || i+1 == len(s) {
+		return 0
+	}
+	r, size := utf8.DecodeRuneInString(s[i+1:])
+	if !isEscapable(r) {
+		return 0
+	}
+	return 1 + size
+}
+
+// trimComponent removes the whitespace around a still escaped component,
+// but not an escaped whitespace character at its end.
+func trimComponent(s string) string {
+	s = strings.TrimLeftFunc(s, unicode.IsSpace)
+	trimmed := strings.TrimRightFunc(s, unicode.IsSpace)
+	if len(trimmed) == len(s) {
+		return trimmed
+	}
+	// The first whitespace character is escaped if an odd number of
+	// backslashes precede it.
+	if n := len(trimmed) - len(strings.TrimRight(trimmed, "\\")); n%2 == 1 {
+		_, size := utf8.DecodeRuneInString(s[len(trimmed):])
+		return s[:len(trimmed)+size]
+	}
+	return trimmed
+}
+
+// splitComponents splits s on the commas which are not escaped, the
+// components are returned still escaped.
+func splitComponents(s string) []string {
+	components := []string{}
+	start := 0
+	for i := 0; i < len(s); i++ {
+		if n := escapedAt(s, i); n != 0 {
+			i += n - 1
+			continue
+		}
+		if s[i] == ',' {
+			components = append(components, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(components, s[start:])
+}
+
+func unescapeComponent(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+	out := strings.Builder{}
+	for i := 0; i < len(s); i++ {
+		if escapedAt(s, i) != 0 {
+			i++
+		}
+		out.WriteByte(s[i])
+	}
+	return out.String()
+}
+
+// escapeComponent escapes the characters of s which Parse would not keep
+// as-is, whitespace only needing it at the edges of s.
+func escapeComponent(s string) string {
+	out := strings.Builder{}
+	for i, r := range s {
+		_, size := utf8.DecodeRuneInString(s[i:])
+		isEdge := i == 0 || i+size == len(s)
+		if isEscapable(r) && (isEdge || !unicode.IsSpace(r)) {
+			out.WriteByte('\\')
+		}
+		out.WriteString(s[i : i+size])
+	}
+	return out.String()
+}
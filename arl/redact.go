@@ -0,0 +1,87 @@
+// *************************************************************************
+//
+// REFRACTION POINT CONFIDENTIAL
+// __________________
+//
+//  Copyright 2018 Refraction Point Inc.
+//  All Rights Reserved.
+//
+// NOTICE:  All information contained herein is, and remains
+// the property of Refraction Point Inc. and its suppliers,
+// if any.  The intellectual and technical concepts contained
+// herein are proprietary to Refraction Point Inc
+// and its suppliers and may be covered by U.S. and Foreign Patents,
+// patents in process, and are protected by trade secret or copyright law.
+// Dissemination of this information or reproduction of this material
+// is strictly forbidden unless prior written permission is obtained
+// from Refraction Point Inc.
+//
+
+package arl
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// redactedPlaceholder replaces secrets in the redacted forms.
+const redactedPlaceholder = "<redacted>"
+
+// Redact returns the redacted form of an ARL string, safe to log. If the
+// string cannot be parsed, nothing of it is kept since there is no telling
+// where the secrets are.
+func Redact(arl string) string {
+	a, err := Parse(arl)
+	if err != nil {
+		return "[" + redactedPlaceholder + "]"
+	}
+	return a.Redacted()
+}
+
+// Redacted returns the canonical form of the ARL with the auth data
+// masked, as well as any credentials or query in an http(s) destination.
+func (a ARL) Redacted() string {
+	return a.redact().String()
+}
+
+func (a ARL) redact() ARL {
+	if a.AuthData != "" {
+		a.AuthData = redactedPlaceholder
+	}
+	if a.Method == "http" || a.Method == "https" {
+		scheme := a.Method + "://"
+		a.Destination = strings.TrimPrefix(redactURL(scheme+a.Destination), scheme)
+	}
+	return a
+}
+
+// GoString makes %#v print the ARL redacted.
+func (a ARL) GoString() string {
+	r := a.redact()
+	return fmt.Sprintf("arl.ARL{Method:%q, Destination:%q, AuthType:%q, AuthData:%q, Options:%q}", r.Method, r.Destination, r.AuthType, r.AuthData, r.Options)
+}
+
+func (a ARL) LogValue() slog.Value {
+	r := a.redact()
+	return slog.GroupValue(
+		slog.String("method", r.Method),
+		slog.String("destination", r.Destination),
+		slog.String("auth_type", r.AuthType),
+		slog.String("options", r.Options),
+	)
+}
+
+// String returns the redacted ARL, use ARL().String() to get the full
+// one back.
+func (a AuthenticatedResourceLocator) String() string {
+	return a.ARL().Redacted()
+}
+
+func (a AuthenticatedResourceLocator) GoString() string {
+	return fmt.Sprintf("arl.AuthenticatedResourceLocator{ARL:%q, MaxSize:%d, MaxConcurrent:%d}", a.ARL().Redacted(), a.maxSize, a.maxConcurrent)
+}
+
+func (a AuthenticatedResourceLocator) LogValue() slog.Value {
+	return a.ARL().LogValue()
+}
@@ -0,0 +1,217 @@
+// *************************************************************************
+//
+// REFRACTION POINT CONFIDENTIAL
+// __________________
+//
+//  Copyright 2018 Refraction Point Inc.
+//  All Rights Reserved.
+//
+// NOTICE:  All information contained herein is, and remains
+// the property of Refraction Point Inc. and its suppliers,
+// if any.  The intellectual and technical concepts contained
+// herein are proprietary to Refraction Point Inc
+// and its suppliers and may be covered by U.S. and Foreign Patents,
+// patents in process, and are protected by trade secret or copyright law.
+// Dissemination of this information or reproduction of this material
+// is strictly forbidden unless prior written permission is obtained
+// from Refraction Point Inc.
+//
+
+package arl
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// StreamContent is a single resource produced by FetchStream. Unlike
+// Content, the data is not buffered: it is read from Reader, which the
+// consumer must always Close, even when it does not read from it.
+type StreamContent struct {
+	// FilePath and SourceURI are as described for Content.
+	FilePath  string
+	SourceURI string
+	Reader    io.ReadCloser
+	Error     error
+	Metadata
+	// Unpack is set by the methods on the resource of a single resource
+	// fetch, Fetch then unpacks it if it is an archive unless the
+	// UnpackOptions say otherwise.
+	Unpack bool
+}
+
+// FetchStream fetches the resources like FetchContext does but without
+// buffering them in memory, each resource is exposed as a reader instead.
+// Archives are unpacked according to the UnpackOptions straight from the
+// fetched stream, except for zip archives which need to be buffered.
+//
+// Some sources are read sequentially, in which case the next resource
+// is only produced once the Reader of the current one has been closed.
+// This is always the case for the files of an archive. The channel may
+// only be closed once every Reader received has been closed.
+func (a *AuthenticatedResourceLocator) FetchStream(ctx context.Context) (chan StreamContent, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	a.logger.Debug("fetching", "arl", a)
+	// The producers are stopped once the file limit is reached, they would
+	// otherwise keep reading the source for nothing.
+	ctx, cancel := context.WithCancel(ctx)
+	chOut, err := a.method.Fetch(ctx, *a)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	chOut = limitStream(ctx, chOut, a.maxSize)
+	chOut = unpackStreams(ctx, chOut, a.unpackOptions, a.maxSize, a.filter)
+	notFound := fmt.Errorf("%w: no file selected in %s", ErrorResourceNotFound, a)
+	return limitFiles(ctx, cancel, chOut, a.maxFiles, notFound), nil
+}
+
+// sendStream delivers s on ch unless ctx is done first, in which case the
+// reader of s is closed and false is returned.
+func sendStream(ctx context.Context, ch chan<- StreamContent, s StreamContent) bool {
+	select {
+	case ch <- s:
+		return true
+	case <-ctx.Done():
+		if s.Reader != nil {
+			s.Reader.Close()
+		}
+		return false
+	}
+}
+
+// finishStream is the StreamContent equivalent of finishContent.
+func finishStream(ctx context.Context, ch chan StreamContent) {
+	if err := ctx.Err(); err != nil {
+		select {
+		case ch <- StreamContent{Error: err}:
+		default:
+		}
+	}
+	close(ch)
+}
+
+// entryReader wraps a reader which is only valid until the consumer is
+// done with it, like the current entry of a tar stream. The producer waits
+// on done before moving on to the next entry.
+type entryReader struct {
+	io.Reader
+	once sync.Once
+	done chan struct{}
+}
+
+func newEntryReader(r io.Reader) *entryReader {
+	return &entryReader{
+		Reader: r,
+		done:   make(chan struct{}),
+	}
+}
+
+func (e *entryReader) Close() error {
+	e.once.Do(func() {
+		close(e.done)
+	})
+	return nil
+}
+
+// wait blocks until the entry is closed, it returns false if ctx is
+// done first.
+func (e *entryReader) wait(ctx context.Context) bool {
+	select {
+	case <-e.done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// onCloseReader calls onClose once the wrapped reader has been closed.
+type onCloseReader struct {
+	io.ReadCloser
+	once    sync.Once
+	onClose func()
+}
+
+func (r *onCloseReader) Close() error {
+	err := r.ReadCloser.Close()
+	r.once.Do(r.onClose)
+	return err
+}
+
+// bufferContent reads every resource of chIn into memory, using up to
+// nWorkers concurrent readers. The resources are produced in the order
+// they were received, so that the files of an archive keep theirs.
+func bufferContent(ctx context.Context, chIn chan StreamContent, nWorkers uint64) chan Content {
+	if nWorkers == 0 {
+		nWorkers = 1
+	}
+	chOut := make(chan Content, nWorkers)
+	// pending holds the results to come in order, its capacity bounds
+	// the number of resources being read at once.
+	pending := make(chan chan Content, nWorkers)
+
+	go func() {
+		defer close(pending)
+		for s := range chIn {
+			result := make(chan Content, 1)
+			select {
+			case pending <- result:
+			case <-ctx.Done():
+				if s.Reader != nil {
+					s.Reader.Close()
+				}
+				// Release whatever the producers queued before
+				// noticing the cancellation.
+				for s := range chIn {
+					if s.Reader != nil {
+						s.Reader.Close()
+					}
+				}
+				return
+			}
+			go func() {
+				result <- readContent(s)
+			}()
+		}
+	}()
+
+	go func() {
+		isSending := true
+		for result := range pending {
+			c := <-result
+			if isSending && !sendContent(ctx, chOut, c) {
+				isSending = false
+			}
+		}
+		finishContent(ctx, chOut)
+	}()
+
+	return chOut
+}
+
+// readContent reads the data of s and closes its reader.
+func readContent(s StreamContent) Content {
+	c := Content{
+		FilePath:  s.FilePath,
+		SourceURI: s.SourceURI,
+		Error:     s.Error,
+		Metadata:  s.Metadata,
+	}
+	if s.Reader == nil {
+		return c
+	}
+	data, err := io.ReadAll(s.Reader)
+	s.Reader.Close()
+	if err == nil {
+		c.Data = data
+		c.Size = int64(len(data))
+	} else if c.Error == nil {
+		// Part of the data is of no use.
+		c.Error = err
+	}
+	return c
+}
@@ -0,0 +1,178 @@
+// *************************************************************************
+//
+// REFRACTION POINT CONFIDENTIAL
+// __________________
+//
+//  Copyright 2018 Refraction Point Inc.
+//  All Rights Reserved.
+//
+// NOTICE:  All information contained herein is, and remains
+// the property of Refraction Point Inc. and its suppliers,
+// if any.  The intellectual and technical concepts contained
+// herein are proprietary to Refraction Point Inc
+// and its suppliers and may be covered by U.S. and Foreign Patents,
+// patents in process, and are protected by trade secret or copyright law.
+// Dissemination of this information or reproduction of this material
+// is strictly forbidden unless prior written permission is obtained
+// from Refraction Point Inc.
+//
+
+package arl
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"time"
+)
+
+// FetchToDirOptions controls how FetchToDir writes the files.
+type FetchToDirOptions struct {
+	// Delete removes the files of the directory which were not fetched,
+	// only once the whole fetch succeeded with at least one file.
+	Delete bool
+	// FileMode is the mode of the files whose source does not provide
+	// one, 0644 if 0.
+	FileMode fs.FileMode
+}
+
+// FetchToDir fetches the resources into dir, creating it if needed, each
+// file being written at its FilePath within dir. Each file is streamed to
+// a temporary file renamed into place once complete, so readers of dir
+// never see partial files, and no file can be written outside of dir. The
+// modes and modification times are preserved when known. The files which
+// could not be fetched are reported together once the fetch is done, the
+// first error aborting the whole fetch is returned right away.
+func (a *AuthenticatedResourceLocator) FetchToDir(ctx context.Context, dir string, opts FetchToDirOptions) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	ch, err := a.FetchStream(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		cancel()
+		for s := range ch {
+			if s.Reader != nil {
+				s.Reader.Close()
+			}
+		}
+	}()
+
+	written := map[string]bool{}
+	fileErrors := []error{}
+	for s := range ch {
+		err := s.Error
+		if s.Reader != nil {
+			if err == nil {
+				err = saveFile(root, s, opts, written)
+			}
+			s.Reader.Close()
+		}
+		if err == nil {
+			continue
+		}
+		if a.isFatal(s.FilePath, err) {
+			return err
+		}
+		fileErrors = append(fileErrors, fmt.Errorf("%s: %w", s.FilePath, err))
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if len(fileErrors) != 0 {
+		return errors.Join(fileErrors...)
+	}
+
+	if opts.Delete {
+		// Emptying the directory because of an empty fetch is never
+		// what was meant.
+		if len(written) == 0 {
+			return fmt.Errorf("%w: no file fetched, nothing deleted", ErrorResourceNotFound)
+		}
+		return deleteStale(root, written)
+	}
+	return nil
+}
+
+// saveFile writes the data of s within root through a temporary file,
+// recording its name in written once done.
+func saveFile(root *os.Root, s StreamContent, opts FetchToDirOptions, written map[string]bool) error {
+	name, err := cleanEntryName(s.FilePath)
+	if err != nil {
+		return err
+	}
+	if err := root.MkdirAll(path.Dir(name), 0755); err != nil {
+		return err
+	}
+	mode := s.Mode.Perm()
+	if mode == 0 {
+		mode = opts.FileMode
+	}
+	if mode == 0 {
+		mode = 0644
+	}
+
+	tmpName := path.Join(path.Dir(name), fmt.Sprintf(".%s.%s.tmp", path.Base(name), rand.Text()))
+	f, err := root.OpenFile(tmpName, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, s.Reader)
+	if err == nil {
+		// Not subject to the umask, unlike the mode given at creation.
+		err = f.Chmod(mode)
+	}
+	if errClose := f.Close(); err == nil {
+		err = errClose
+	}
+	if err == nil && !s.ModTime.IsZero() {
+		err = root.Chtimes(tmpName, time.Now(), s.ModTime)
+	}
+	if err == nil {
+		err = root.Rename(tmpName, name)
+	}
+	if err != nil {
+		root.Remove(tmpName)
+		return err
+	}
+	written[name] = true
+	return nil
+}
+
+// deleteStale removes the regular files of root which are not in keep.
+func deleteStale(root *os.Root, keep map[string]bool) error {
+	stale := []string{}
+	err := fs.WalkDir(root.FS(), ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() && !keep[name] {
+			stale = append(stale, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, name := range stale {
+		if err := root.Remove(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
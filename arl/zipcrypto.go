@@ -0,0 +1,252 @@
+// *************************************************************************
+//
+// REFRACTION POINT CONFIDENTIAL
+// __________________
+//
+//  Copyright 2018 Refraction Point Inc.
+//  All Rights Reserved.
+//
+// NOTICE:  All information contained herein is, and remains
+// the property of Refraction Point Inc. and its suppliers,
+// if any.  The intellectual and technical concepts contained
+// herein are proprietary to Refraction Point Inc
+// and its suppliers and may be covered by U.S. and Foreign Patents,
+// patents in process, and are protected by trade secret or copyright law.
+// Dissemination of this information or reproduction of this material
+// is strictly forbidden unless prior written permission is obtained
+// from Refraction Point Inc.
+//
+
+package arl
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"crypto/aes"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+)
+
+const (
+	zipFlagEncrypted = 0x1
+	zipFlagDataDesc  = 0x8
+
+	// zipMethodAES is the method of the entries encrypted with the
+	// WinZip AES scheme, the actual method is in the AES extra field.
+	zipMethodAES      = 99
+	zipExtraAES       = 0x9901
+	zipAESVendorAE1   = 1
+	zipAESAuthCodeLen = 10
+)
+
+// openZipFile opens an entry of a zip, decrypting it with password if it
+// is encrypted with either the traditional PKWARE scheme (ZipCrypto) or
+// the WinZip AES one.
+func openZipFile(f *zip.File, password string) (io.ReadCloser, error) {
+	if f.Flags&zipFlagEncrypted == 0 {
+		return f.Open()
+	}
+	if password == "" {
+		return nil, fmt.Errorf("%w: %s is encrypted and no password was set", ErrorInvalidPassword, f.Name)
+	}
+
+	rawReader, err := f.OpenRaw()
+	if err != nil {
+		return nil, err
+	}
+	raw, err := io.ReadAll(rawReader)
+	if err != nil {
+		return nil, err
+	}
+
+	method := f.Method
+	checkCRC := true
+	var data []byte
+	if method == zipMethodAES {
+		var vendorVersion uint16
+		data, method, vendorVersion, err = decryptZipAES(f, raw, password)
+		// AE-2 zeroes the CRC, the authentication code replaces it.
+		checkCRC = vendorVersion == zipAESVendorAE1
+	} else {
+		data, err = decryptZipCrypto(f, raw, password)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var reader io.ReadCloser
+	switch method {
+	case zip.Store:
+		reader = io.NopCloser(bytes.NewReader(data))
+	case zip.Deflate:
+		reader = flate.NewReader(bytes.NewReader(data))
+	default:
+		return nil, zip.ErrAlgorithm
+	}
+	if !checkCRC {
+		return reader, nil
+	}
+	return &crcReader{
+		ReadCloser: reader,
+		hash:       crc32.NewIEEE(),
+		expected:   f.CRC32,
+		name:       f.Name,
+	}, nil
+}
+
+// crcReader verifies the CRC32 of the data once it has all been read, a
+// mismatch on a decrypted entry means the password was wrong.
+type crcReader struct {
+	io.ReadCloser
+	hash     hash.Hash32
+	expected uint32
+	name     string
+}
+
+func (r *crcReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.hash.Write(p[:n])
+	if err == io.EOF && r.hash.Sum32() != r.expected {
+		return n, fmt.Errorf("%w: checksum mismatch for %s", ErrorInvalidPassword, r.name)
+	}
+	return n, err
+}
+
+// zipCryptoKeys is the state of the traditional PKWARE encryption.
+type zipCryptoKeys [3]uint32
+
+func newZipCryptoKeys(password string) *zipCryptoKeys {
+	k := &zipCryptoKeys{0x12345678, 0x23456789, 0x34567890}
+	for i := 0; i < len(password); i++ {
+		k.update(password[i])
+	}
+	return k
+}
+
+func crc32Update(crc uint32, b byte) uint32 {
+	return crc32.IEEETable[byte(crc)^b] ^ (crc >> 8)
+}
+
+func (k *zipCryptoKeys) update(b byte) {
+	k[0] = crc32Update(k[0], b)
+	k[1] = (k[1]+(k[0]&0xff))*134775813 + 1
+	k[2] = crc32Update(k[2], byte(k[1]>>24))
+}
+
+func (k *zipCryptoKeys) decrypt(b byte) byte {
+	temp := k[2] | 2
+	b ^= byte((temp * (temp ^ 1)) >> 8)
+	k.update(b)
+	return b
+}
+
+func decryptZipCrypto(f *zip.File, raw []byte, password string) ([]byte, error) {
+	// The data is prefixed with a 12 bytes encryption header.
+	if len(raw) < 12 {
+		return nil, fmt.Errorf("invalid encrypted entry %s", f.Name)
+	}
+	keys := newZipCryptoKeys(password)
+	data := make([]byte, len(raw))
+	for i, b := range raw {
+		data[i] = keys.decrypt(b)
+	}
+	// The last byte of the header is a quick check of the password,
+	// against the high byte of the CRC or of the modification time when
+	// the CRC is only known in the data descriptor.
+	check := byte(f.CRC32 >> 24)
+	if f.Flags&zipFlagDataDesc != 0 {
+		check = byte(f.ModifiedTime >> 8)
+	}
+	if data[11] != check {
+		return nil, fmt.Errorf("%w for %s", ErrorInvalidPassword, f.Name)
+	}
+	return data[12:], nil
+}
+
+// decryptZipAES decrypts an entry encrypted with the WinZip AES scheme,
+// returning the data along with the actual compression method and the
+// vendor version of the scheme.
+func decryptZipAES(f *zip.File, raw []byte, password string) ([]byte, uint16, uint16, error) {
+	extra := findZipExtra(f.Extra, zipExtraAES)
+	if len(extra) < 7 {
+		return nil, 0, 0, fmt.Errorf("invalid aes extra field for %s", f.Name)
+	}
+	vendorVersion := binary.LittleEndian.Uint16(extra[0:2])
+	strength := extra[4]
+	method := binary.LittleEndian.Uint16(extra[5:7])
+	if strength < 1 || strength > 3 {
+		return nil, 0, 0, fmt.Errorf("invalid aes strength for %s", f.Name)
+	}
+	keyLen := 8 + 8*int(strength)
+	saltLen := keyLen / 2
+
+	if len(raw) < saltLen+2+zipAESAuthCodeLen {
+		return nil, 0, 0, fmt.Errorf("invalid encrypted entry %s", f.Name)
+	}
+	salt := raw[:saltLen]
+	verifier := raw[saltLen : saltLen+2]
+	encrypted := raw[saltLen+2 : len(raw)-zipAESAuthCodeLen]
+	authCode := raw[len(raw)-zipAESAuthCodeLen:]
+
+	keys, err := pbkdf2.Key(sha1.New, password, salt, 1000, 2*keyLen+2)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	if !bytes.Equal(keys[2*keyLen:], verifier) {
+		return nil, 0, 0, fmt.Errorf("%w for %s", ErrorInvalidPassword, f.Name)
+	}
+
+	mac := hmac.New(sha1.New, keys[keyLen:2*keyLen])
+	mac.Write(encrypted)
+	if !hmac.Equal(mac.Sum(nil)[:zipAESAuthCodeLen], authCode) {
+		return nil, 0, 0, fmt.Errorf("%w: authentication failed for %s", ErrorInvalidPassword, f.Name)
+	}
+
+	block, err := aes.NewCipher(keys[:keyLen])
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	// WinZip uses CTR mode with a little endian counter starting at 1,
+	// which the standard library does not provide.
+	data := make([]byte, len(encrypted))
+	counter := make([]byte, aes.BlockSize)
+	keyStream := make([]byte, aes.BlockSize)
+	for i := 0; i < len(encrypted); i += aes.BlockSize {
+		for j := range counter {
+			counter[j]++
+			if counter[j] != 0 {
+				break
+			}
+		}
+		block.Encrypt(keyStream, counter)
+		for j := i; j < i+aes.BlockSize && j < len(encrypted); j++ {
+			data[j] = encrypted[j] ^ keyStream[j-i]
+		}
+	}
+
+	return data, method, vendorVersion, nil
+}
+
+// findZipExtra returns the data of the extra field with the given id.
+func findZipExtra(extra []byte, id uint16) []byte {
+	for len(extra) >= 4 {
+		fieldID := binary.LittleEndian.Uint16(extra[0:2])
+		size := int(binary.LittleEndian.Uint16(extra[2:4]))
+		extra = extra[4:]
+		if size > len(extra) {
+			return nil
+		}
+		if fieldID == id {
+			return extra[:size]
+		}
+		extra = extra[size:]
+	}
+	return nil
+}